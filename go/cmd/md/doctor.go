@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+
+	"github.com/mscheidegger/minidisc/go/pkg/minidisc"
+)
+
+// doctorCheck is one step of 'md doctor'. Run returns details to print on
+// success. On failure, the hint tells the user what to do about it.
+type doctorCheck struct {
+	title string
+	run   func() (string, error)
+	hint  string
+}
+
+func doctor(params []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	port := portFlag(flags)
+	flags.Parse(params)
+	if flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "'doctor' doesn't take parameters")
+		os.Exit(exitUsage)
+	}
+	opts := minidisc.QueryOptions{Port: port()}
+	name := fmt.Sprintf("md-doctor-%d", os.Getpid())
+
+	// The checks share state, each relying on the ones before it.
+	var tmap minidisc.TailnetMap
+	var registry *minidisc.Registry
+	checks := []doctorCheck{
+		{
+			title: "tailscaled socket",
+			run: func() (string, error) {
+				conn, err := net.Dial("unix", minidisc.DefaultTailscaledSocket)
+				if err != nil {
+					return "", err
+				}
+				conn.Close()
+				return minidisc.DefaultTailscaledSocket, nil
+			},
+			hint: "Is tailscaled running? In Docker, share its socket with a volume, " +
+				"see the README.",
+		},
+		{
+			title: "Tailnet status",
+			run: func() (string, error) {
+				var err error
+				if tmap, err = minidisc.CurrentTailnet(); err != nil {
+					return "", err
+				}
+				return fmt.Sprintf(
+					"local address %s, %d peers online", tmap.LocalAddr, len(tmap.Peers()),
+				), nil
+			},
+			hint: "Check 'tailscale status'. The node must be logged in and have an " +
+				"IPv4 Tailnet address.",
+		},
+		{
+			title: "Registry port",
+			run: func() (string, error) {
+				return checkRegistryPort(netip.AddrPortFrom(tmap.LocalAddr, opts.Port))
+			},
+			hint: "Stop the server that uses the port, or use --port for all Minidisc " +
+				"tools and registries.",
+		},
+		{
+			title: "Advertise test service",
+			run: func() (string, error) {
+				var err error
+				registry, err = minidisc.StartRegistryWithOptions(
+					minidisc.StartRegistryOptions{Port: opts.Port},
+				)
+				if err != nil {
+					return "", err
+				}
+				if err := registry.AdvertiseService(registry.Addr().Port(), name, nil); err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%s as %s at %s", name, registry.Role(), registry.Addr()), nil
+			},
+			hint: "Check that the local firewall allows connections on the Tailnet " +
+				"address, and run with --verbose for details.",
+		},
+		{
+			title: "Find test service",
+			run: func() (string, error) {
+				ss, err := minidisc.ListServicesWithOptions(opts)
+				if err != nil {
+					return "", err
+				}
+				if !slices.ContainsFunc(ss, func(s minidisc.Service) bool { return s.Name == name }) {
+					return "", fmt.Errorf("%s isn't listed", name)
+				}
+				return fmt.Sprintf("%d services listed", len(ss)), nil
+			},
+			hint: "The local registry is up but not found. Run 'md ping' for this " +
+				"node, and run with --verbose for details.",
+		},
+		{
+			title: "Unlist test service",
+			run: func() (string, error) {
+				return "", registry.UnlistServiceByName(name)
+			},
+			hint: "This is a bug, please report it.",
+		},
+	}
+	ok := runChecks(checks)
+	if registry != nil {
+		registry.Close()
+	}
+	if !ok {
+		os.Exit(exitFailure)
+	}
+}
+
+// checkRegistryPort checks that ap, the registry port on this host, is either
+// free or taken by a Minidisc registry.
+func checkRegistryPort(ap netip.AddrPort) (string, error) {
+	if rtt, err := minidisc.Ping(ap); err == nil {
+		return fmt.Sprintf("leader answers on %s in %v", ap, rtt), nil
+	}
+	ln, err := net.Listen("tcp", ap.String())
+	if err == nil {
+		ln.Close()
+		return fmt.Sprintf("%s is free, the next registry becomes leader", ap), nil
+	}
+	return "", fmt.Errorf("%s is taken by something other than a Minidisc registry", ap)
+}
+
+// runChecks runs checks in order and prints the results. After the first
+// failure, the remaining checks are skipped. Returns whether all passed.
+func runChecks(checks []doctorCheck) bool {
+	for i, c := range checks {
+		details, err := c.run()
+		if err == nil {
+			if details != "" {
+				fmt.Printf("[ OK ] %s: %s\n", c.title, details)
+			} else {
+				fmt.Printf("[ OK ] %s\n", c.title)
+			}
+			continue
+		}
+		fmt.Printf("[FAIL] %s: %v\n", c.title, err)
+		fmt.Printf("       %s\n", c.hint)
+		for _, skipped := range checks[i+1:] {
+			fmt.Printf("[SKIP] %s\n", skipped.title)
+		}
+		return false
+	}
+	return true
+}
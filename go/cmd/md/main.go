@@ -1,47 +1,130 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"maps"
+	"math"
+	"net"
 	"net/netip"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"text/tabwriter"
+	"time"
 
 	"github.com/mscheidegger/minidisc/go/pkg/minidisc"
 	"gopkg.in/yaml.v3"
 )
 
-const usage = `Usage: md <command> [parameters]
+const usage = `Usage: md [-v|--verbose] <command> [parameters]
+
+With -v or --verbose, log details of discovery, e.g. which registries were
+queried and how they answered.
 
 Available commands:
-  list - Print a list of advertised services on the Tailnet.
-  find <name> [key=val] ...  - Find a service, given name and labels.
-  advertise <cfgfile> - Read service config from YAML and advertise it.
+  list [--sources] [--sort=name|address|age] [--group-by=name|<label>] - Print
+      a list of advertised services on the Tailnet. With --sources, also show
+      the address of the registry advertising each. --sort orders the list by
+      name (default), by address, or by age with the most recently advertised
+      first. --group-by groups the list by service name or by the value of a
+      label, with services lacking the label under "(none)".
+  find [--regexp] [-q] <name> [key=val] ...  - Find a service, given name and
+      labels. A name containing * or ? is a glob pattern and prints all
+      matching services. With --regexp, the name is a regular expression.
+      A label given as key=* matches any value, as long as the label exists.
+      With -q, print exactly one host:port, for use in $(md find -q ...).
+      Exits with 1 if no service matches, and with 2 on other errors.
+  advertise [--check] [--dns=<addr>] <cfgfile> ... - Read service config from
+      YAML and advertise it. Takes one or more files, or directories to read
+      all *.yaml files from. With --check, only validate the config and report
+      errors.
+      All values, i.e. names, aliases, addresses, labels, annotations, schemes
+      and gRPC configs, can refer to environment variables as ${VAR}, or
+      ${VAR:-default} for a fallback value if VAR is unset or empty.
+      Label values of local services can also contain {{hostname}},
+      {{tailnet_ip}}, {{os}} and {{arch}}, which are filled in with this host's
+      values. Write {{{{ for a literal {{.
+      On SIGHUP, the config is re-read and only changed services are updated.
+      A service's address is either local, as "8080", ":8080", "0.0.0.0:8080"
+      or "localhost:8080", which all mean this host's Tailnet address, or
+      remote, as "<ip>:<port>" or "<tailnet-host>:<port>".
+      With --dns, also answer DNS queries for <service>.minidisc on the given
+      UDP address, e.g. 127.0.0.1:5353, with the addresses of all services of
+      that name on the Tailnet.
+  ping <host>[:port] | --all - Check that the Minidisc registry on a Tailnet
+      node answers, and print the round-trip time. The port defaults to --port.
+      With --all, ping every online node and print a table of the results.
+  peers - Print the Tailnet nodes as Minidisc sees them: the local host, the
+      online peers it queries, and known nodes that are offline.
+  proxy <addr> - Serve HTTP on addr, e.g. :8080, and forward requests to the
+      service named by the Host header, as in "Host: myservice.minidisc", or
+      else by the first path segment, as in "/myservice/index.html", which is
+      stripped. Returns 404 if there's no such service.
+  doctor - Check the whole discovery path step by step: tailscaled, the
+      Tailnet status, the registry port, and advertising and finding a
+      temporary test service. Prints hints for the first step that fails.
   help - This page.
-`
+
+Exit codes are 0 on success, 1 on runtime errors, and 2 on invalid command
+lines. 'find' exits with 1 if nothing matches, and with 2 on all other errors.
+
+list, find, advertise, proxy, ping and doctor take --port <port> to use
+registries on a port other than 28004, e.g. to keep separate meshes on the same
+Tailnet.`
+
+// Exit codes. log.Fatal exits with exitFailure, too.
+const (
+	// exitFailure means that the command failed at runtime, e.g. because
+	// the Tailnet is unavailable, or that 'find' found nothing.
+	exitFailure = 1
+	// exitUsage means that the command line was invalid.
+	exitUsage = 2
+	// exitFindError is used by 'find' for errors other than finding nothing,
+	// so scripts can tell the two apart.
+	exitFindError = 2
+)
 
 type Config struct {
 	Services []Service `yaml:"services"`
 }
 
 type Service struct {
-	Name    string            `yaml:"name"`
-	Address string            `yaml:"address"`
-	Labels  map[string]string `yaml:"labels"`
+	Name        string            `yaml:"name"`
+	Aliases     []string          `yaml:"aliases"`
+	Address     string            `yaml:"address"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+	Scheme      string            `yaml:"scheme"`
+	GRPCConfig  string            `yaml:"grpcConfig"`
 }
 
 func main() {
-	minidisc.SetLogger(minidisc.LevelLogger{Level: 2})
-	if len(os.Args) < 2 {
+	flags := flag.NewFlagSet("md", flag.ExitOnError)
+	flags.Usage = help
+	var verbose bool
+	flags.BoolVar(&verbose, "v", false, "Log discovery details.")
+	flags.BoolVar(&verbose, "verbose", false, "Log discovery details.")
+	flags.Parse(os.Args[1:])
+	if verbose {
+		minidisc.SetLogger(minidisc.LevelLogger{Level: 0})
+	} else {
+		minidisc.SetLogger(minidisc.LevelLogger{Level: 2})
+	}
+	if flags.NArg() < 1 {
 		help()
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
-	cmd := os.Args[1]
-	params := os.Args[2:len(os.Args)]
+	cmd := flags.Arg(0)
+	params := flags.Args()[1:]
 	switch cmd {
 	case "list":
 		list(params)
@@ -49,12 +132,20 @@ func main() {
 		find(params)
 	case "advertise":
 		advertise(params)
+	case "ping":
+		ping(params)
+	case "peers":
+		peers(params)
+	case "proxy":
+		proxy(params)
+	case "doctor":
+		doctor(params)
 	case "help":
 		help()
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", cmd)
 		help()
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
 }
 
@@ -62,15 +153,44 @@ func help() {
 	fmt.Fprintln(os.Stderr, usage)
 }
 
+// portFlag adds the --port flag to flags. The returned function gives its
+// value once flags are parsed, and exits if it's not a valid port.
+func portFlag(flags *flag.FlagSet) func() uint16 {
+	port := flags.Uint("port", uint(minidisc.DefaultPort), "Port of the Minidisc registries.")
+	return func() uint16 {
+		if *port == 0 || *port > math.MaxUint16 {
+			fmt.Fprintf(os.Stderr, "Invalid port %d\n", *port)
+			os.Exit(exitUsage)
+		}
+		return uint16(*port)
+	}
+}
+
 func list(params []string) {
-	if len(params) > 0 {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	sources := flags.Bool("sources", false, "Show which registry advertises each service.")
+	sortKey := flags.String("sort", "name", "Order by name, address or age.")
+	groupBy := flags.String("group-by", "", "Group by name or by the value of a label.")
+	port := portFlag(flags)
+	flags.Parse(params)
+	if flags.NArg() > 0 {
 		fmt.Fprintln(os.Stderr, "'list' doesn't take parameters")
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
-	ss, err := minidisc.ListServices()
+	compare, ok := listOrders[*sortKey]
+	if !ok {
+		fmt.Fprintf(
+			os.Stderr, "Invalid sort key '%s', must be one of: name, address, age\n",
+			*sortKey,
+		)
+		os.Exit(exitUsage)
+	}
+	ss, err := minidisc.ListServicesWithOptions(minidisc.QueryOptions{Port: port()})
 	if err != nil {
 		log.Fatal(err)
 	}
+	// ListServices sorts by name, so ties stay in that order.
+	slices.SortStableFunc(ss, compare)
 	if len(ss) == 0 {
 		fmt.Fprintln(os.Stderr, "No advertised services found")
 		return
@@ -83,11 +203,138 @@ func list(params []string) {
 		' ', // padchar
 		0,   // options
 	)
+	if *groupBy == "" {
+		printServices(tw, ss, *sources)
+	} else {
+		for i, g := range groupServices(ss, *groupBy) {
+			if i > 0 {
+				fmt.Fprintln(tw)
+			}
+			fmt.Fprintf(tw, "%s:\n", g.title)
+			printServices(tw, g.services, *sources)
+		}
+	}
+	tw.Flush()
+}
+
+// printServices prints a table row per service to tw.
+func printServices(tw *tabwriter.Writer, ss []minidisc.Service, sources bool) {
 	for _, s := range ss {
 		labels := fmtLabels(s.Labels)
-		fmt.Fprintf(tw, "* %s\t%s\t%s\t\n", s.Name, s.AddrPort.String(), labels)
+		annotations := ""
+		if len(s.Annotations) > 0 {
+			annotations = fmtLabels(s.Annotations)
+		}
+		fmt.Fprintf(
+			tw, "* %s\t%s\t%s\t%s\t%s\t",
+			fmtName(s), fmtAddr(s), labels, annotations, fmtAge(s),
+		)
+		if sources {
+			fmt.Fprintf(tw, "via %s\t", s.Source.String())
+		}
+		fmt.Fprintln(tw)
 	}
-	tw.Flush()
+}
+
+// noGroup is the title of the group of services that lack the label grouped by.
+const noGroup = "(none)"
+
+type serviceGroup struct {
+	title    string
+	services []minidisc.Service
+}
+
+// groupServices groups ss by name if key is "name", or else by the value of
+// the label key. Groups are sorted by title, with noGroup last, and keep the
+// order of ss within.
+func groupServices(ss []minidisc.Service, key string) []serviceGroup {
+	var groups []serviceGroup
+	index := make(map[string]int)
+	for _, s := range ss {
+		title := s.Name
+		if key != "name" {
+			title = noGroup
+			if v, ok := s.Labels[key]; ok {
+				title = fmt.Sprintf("%s=%s", key, v)
+			}
+		}
+		i, ok := index[title]
+		if !ok {
+			i = len(groups)
+			index[title] = i
+			groups = append(groups, serviceGroup{title: title})
+		}
+		groups[i].services = append(groups[i].services, s)
+	}
+	slices.SortFunc(groups, func(a, b serviceGroup) int {
+		if c := cmpBool(a.title == noGroup, b.title == noGroup); c != 0 {
+			return c
+		}
+		return strings.Compare(a.title, b.title)
+	})
+	return groups
+}
+
+// listOrders are the orders that 'list --sort' supports.
+var listOrders = map[string]func(a, b minidisc.Service) int{
+	"name": func(a, b minidisc.Service) int {
+		return strings.Compare(a.Name, b.Name)
+	},
+	"address": func(a, b minidisc.Service) int {
+		if c := a.AddrPort.Compare(b.AddrPort); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Target, b.Target)
+	},
+	// Most recently advertised first, and services without a time last.
+	"age": func(a, b minidisc.Service) int {
+		if a.RegisteredAt.IsZero() || b.RegisteredAt.IsZero() {
+			return cmpBool(a.RegisteredAt.IsZero(), b.RegisteredAt.IsZero())
+		}
+		return b.RegisteredAt.Compare(a.RegisteredAt)
+	},
+}
+
+// cmpBool orders false before true.
+func cmpBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// fmtName returns the name of the service, followed by its aliases, if any.
+func fmtName(s minidisc.Service) string {
+	if len(s.Aliases) == 0 {
+		return s.Name
+	}
+	return fmt.Sprintf("%s (%s)", s.Name, strings.Join(s.Aliases, ", "))
+}
+
+// fmtAddr returns the address of a TCP service, or the target of others. If
+// the service has a scheme, it's prepended.
+func fmtAddr(s minidisc.Service) string {
+	addr := s.Target
+	if s.AddrPort.IsValid() {
+		addr = s.AddrPort.String()
+	}
+	if s.Scheme != "" {
+		return fmt.Sprintf("%s://%s", s.Scheme, addr)
+	}
+	return addr
+}
+
+// fmtAge returns how long ago the service was advertised, or nothing if its
+// registry doesn't say.
+func fmtAge(s minidisc.Service) string {
+	if s.RegisteredAt.IsZero() {
+		return ""
+	}
+	return "up " + time.Since(s.RegisteredAt).Truncate(time.Second).String()
 }
 
 func fmtLabels(labels map[string]string) string {
@@ -103,9 +350,16 @@ func fmtLabels(labels map[string]string) string {
 }
 
 func find(params []string) {
+	flags := flag.NewFlagSet("find", flag.ExitOnError)
+	useRegexp := flags.Bool("regexp", false, "Interpret the name as regular expression.")
+	quiet := flags.Bool("q", false, "Print only the first match, and no error if nothing matches.")
+	port := portFlag(flags)
+	flags.Parse(params)
+	opts := minidisc.QueryOptions{Port: port()}
+	params = flags.Args()
 	if len(params) < 1 {
 		fmt.Fprintln(os.Stderr, "'find' takes at least 1 parameter")
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
 	name := params[0]
 	labels := make(map[string]string)
@@ -113,60 +367,363 @@ func find(params []string) {
 		parts := strings.SplitN(p, "=", 2)
 		if len(parts) != 2 {
 			fmt.Fprintf(os.Stderr, "Cannot parse label '%s'\n", p)
-			os.Exit(2)
+			os.Exit(exitUsage)
 		}
 		labels[parts[0]] = parts[1]
 	}
-	if addr, err := minidisc.FindService(name, labels); err == nil {
-		fmt.Println(addr.String())
-	} else {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
+	if *useRegexp || strings.ContainsAny(name, "*?") {
+		syntax := minidisc.Glob
+		if *useRegexp {
+			syntax = minidisc.Regexp
+		}
+		ss, err := minidisc.FindServicesPatternWithOptions(name, labels, syntax, opts)
+		if err != nil {
+			exitFind(err, *quiet)
+		}
+		if *quiet {
+			// Only TCP services have a host:port to print.
+			i := slices.IndexFunc(ss, func(s minidisc.Service) bool {
+				return s.AddrPort.IsValid()
+			})
+			if i < 0 {
+				os.Exit(exitFailure)
+			}
+			ss = ss[i : i+1]
+		}
+		for _, s := range ss {
+			fmt.Println(s.AddrPort.String())
+		}
+		return
+	}
+	addr, err := minidisc.FindServiceWithOptions(name, labels, opts)
+	if err != nil {
+		exitFind(err, *quiet)
 	}
+	fmt.Println(addr.String())
 }
 
-func advertise(params []string) {
-	if len(params) != 1 {
-		fmt.Fprintln(os.Stderr, "'advertise' takes exactly 1 parameter")
-		os.Exit(2)
+// exitFind reports err and exits with exitFailure if no service was found, or
+// with exitFindError on other errors. If quiet, not finding a service isn't reported.
+func exitFind(err error, quiet bool) {
+	if errors.Is(err, minidisc.ErrServiceNotFound) {
+		if !quiet {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		os.Exit(exitFailure)
+	}
+	fmt.Fprintf(os.Stderr, "%v\n", err)
+	os.Exit(exitFindError)
+}
+
+func ping(params []string) {
+	flags := flag.NewFlagSet("ping", flag.ExitOnError)
+	all := flags.Bool("all", false, "Ping every online node on the Tailnet.")
+	port := portFlag(flags)
+	flags.Parse(params)
+	if *all {
+		if flags.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, "'ping --all' doesn't take parameters")
+			os.Exit(exitUsage)
+		}
+		pingAll(port())
+		return
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "'ping' takes 1 parameter")
+		os.Exit(exitUsage)
+	}
+	hostPort := flags.Arg(0)
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		hostPort = net.JoinHostPort(hostPort, strconv.Itoa(int(port())))
+	}
+	ap, err := minidisc.ResolveRemoteAddr(hostPort)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rtt, err := minidisc.Ping(ap)
+	if err != nil {
+		fmt.Printf("%s unreachable: %v\n", ap, err)
+		os.Exit(exitFailure)
+	}
+	fmt.Printf("%s reachable, %v\n", ap, rtt.Round(time.Microsecond))
+}
+
+// pingAll pings the registry port of all online nodes in parallel and prints
+// which ones answer.
+func pingAll(port uint16) {
+	tmap, err := minidisc.CurrentTailnet()
+	if err != nil {
+		log.Fatal(err)
+	}
+	addrs := append([]netip.Addr{tmap.LocalAddr}, tmap.Peers()...)
+	results := make([]string, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rtt, err := minidisc.Ping(netip.AddrPortFrom(addr, port)); err == nil {
+				results[i] = fmt.Sprintf("up\t%v", rtt.Round(time.Microsecond))
+			} else {
+				results[i] = "down\t"
+			}
+		}()
+	}
+	wg.Wait()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	for i, addr := range addrs {
+		host, _ := minidisc.LookupHostname(addr)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t\n", addr, host, results[i])
+	}
+	tw.Flush()
+}
+
+func peers(params []string) {
+	if len(params) > 0 {
+		fmt.Fprintln(os.Stderr, "'peers' doesn't take parameters")
+		os.Exit(exitUsage)
+	}
+	tmap, err := minidisc.CurrentTailnet()
+	if err != nil {
+		log.Fatal(err)
 	}
-	path := params[0]
-	if path == "-" {
-		path = "/dev/stdin"
+	names := make(map[netip.Addr]string)
+	for name, addr := range tmap.HostAddrs {
+		names[addr] = name
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(tw, "local\t%s\t%s\t\n", tmap.LocalAddr, names[tmap.LocalAddr])
+	delete(names, tmap.LocalAddr)
+	for _, addr := range tmap.Peers() {
+		fmt.Fprintf(tw, "online\t%s\t%s\t\n", addr, names[addr])
+		delete(names, addr)
+	}
+	var offline []netip.Addr
+	for addr := range names {
+		offline = append(offline, addr)
+	}
+	slices.SortFunc(offline, netip.Addr.Compare)
+	for _, addr := range offline {
+		fmt.Fprintf(tw, "offline\t%s\t%s\t\n", addr, names[addr])
+	}
+	tw.Flush()
+}
+
+func advertise(params []string) {
+	flags := flag.NewFlagSet("advertise", flag.ExitOnError)
+	check := flags.Bool("check", false, "Only validate the config file.")
+	dnsAddr := flags.String("dns", "", "UDP address to answer DNS queries on.")
+	port := portFlag(flags)
+	flags.Parse(params)
+	if flags.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "'advertise' takes at least 1 parameter")
+		os.Exit(exitUsage)
 	}
 
-	cfg, err := readConfig(path)
+	paths := flags.Args()
+	cfg, err := readConfigs(paths)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error reading config file: %v\n", err)
-		os.Exit(2)
+		os.Exit(exitFailure)
+	}
+	if *check {
+		os.Exit(checkConfig(cfg))
 	}
 
 	// Start and fill registry.
-	registry, err := minidisc.StartRegistry()
+	registry, err := minidisc.StartRegistryWithOptions(
+		minidisc.StartRegistryOptions{Port: port(), DNSAddr: *dnsAddr},
+	)
 	if err != nil {
 		log.Fatal(err)
 	}
 	for _, s := range cfg.Services {
-		if strings.HasPrefix(s.Address, ":") {
-			port := parsePort(s.Address)
-			if err := registry.AdvertiseService(port, s.Name, s.Labels); err != nil {
-				log.Fatal(err)
+		if err := advertiseService(registry, s); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Wait for a signal before terminating, reloading the config on SIGHUP.
+	log.Println("Advertising services. Reload with SIGHUP, stop by sending SIGINT...")
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for {
+		select {
+		case <-quit:
+			return
+		case <-hup:
+			if slices.Contains(paths, "-") {
+				log.Println("Cannot reload config read from stdin")
+				continue
 			}
-		} else {
-			ap, err := netip.ParseAddrPort(s.Address)
+			newCfg, err := readConfigs(paths)
 			if err != nil {
-				log.Fatalf("Bad address '%s'", s.Address)
+				log.Printf("Error reloading config, keeping the old one: %v", err)
+				continue
+			}
+			cfg = reloadConfig(registry, cfg, newCfg)
+			log.Println("Reloaded config")
+		}
+	}
+}
+
+// advertiseService advertises a service from the config with registry.
+func advertiseService(registry *minidisc.Registry, s Service) error {
+	opts := []minidisc.ServiceOption{
+		minidisc.WithAliases(s.Aliases...),
+		minidisc.WithAnnotations(s.Annotations),
+		minidisc.WithScheme(s.Scheme),
+		minidisc.WithGRPCConfig(s.GRPCConfig),
+	}
+	if port, ok, err := parseLocalAddr(s.Address); err != nil {
+		return err
+	} else if ok {
+		return registry.AdvertiseService(port, s.Name, s.Labels, opts...)
+	}
+	return registry.AdvertiseRemoteServiceHost(s.Address, s.Name, s.Labels, opts...)
+}
+
+// reloadConfig applies the difference between oldCfg and newCfg to registry,
+// leaving unchanged services alone, and returns the config now in effect,
+// which lacks new services that failed to be advertised.
+// Services are matched by address, as that's what the registry tells them
+// apart by. If only their labels changed, they're updated in
+// place; other changes re-advertise them.
+func reloadConfig(registry *minidisc.Registry, oldCfg, newCfg *Config) *Config {
+	oldServices := make(map[string]Service)
+	for _, s := range oldCfg.Services {
+		oldServices[s.Address] = s
+	}
+	var added []Service
+	for _, s := range newCfg.Services {
+		old, ok := oldServices[s.Address]
+		delete(oldServices, s.Address)
+		switch {
+		case !ok:
+			added = append(added, s)
+		case !sameExceptLabels(old, s):
+			// Unlist first, as the new service takes over the address.
+			unlistService(registry, old)
+			added = append(added, s)
+		case !maps.Equal(old.Labels, s.Labels):
+			ap, err := serviceAddr(registry, s)
+			if err == nil {
+				err = registry.UpdateServiceLabelsAt(ap, s.Labels)
 			}
-			if err := registry.AdvertiseRemoteService(ap, s.Name, s.Labels); err != nil {
-				log.Fatal(err)
+			if err != nil {
+				log.Printf("Error updating %s: %v", s.Name, err)
 			}
 		}
 	}
+	// What's left has been removed from the config.
+	for _, s := range oldServices {
+		unlistService(registry, s)
+	}
+	failed := make(map[string]bool)
+	for _, s := range added {
+		if err := advertiseService(registry, s); err != nil {
+			log.Printf("Error advertising %s: %v", s.Name, err)
+			failed[s.Address] = true
+		}
+	}
+	applied := &Config{Services: slices.Clone(newCfg.Services)}
+	applied.Services = slices.DeleteFunc(applied.Services, func(s Service) bool {
+		return failed[s.Address]
+	})
+	return applied
+}
 
-	// Wait for a signal before terminating.
-	log.Println("Advertising services. Stop by sending SIGINT...")
-	quit := make(chan os.Signal)
-	signal.Notify(quit, os.Interrupt)
-	<-quit
+// unlistService unlists a service from the config, and logs errors.
+func unlistService(registry *minidisc.Registry, s Service) {
+	ap, err := serviceAddr(registry, s)
+	if err == nil {
+		err = registry.UnlistServiceAt(ap)
+	}
+	if err != nil {
+		log.Printf("Error unlisting %s: %v", s.Name, err)
+	}
+}
+
+// serviceAddr returns the address at which a service from the config is
+// advertised.
+func serviceAddr(registry *minidisc.Registry, s Service) (netip.AddrPort, error) {
+	if port, ok, err := parseLocalAddr(s.Address); err != nil {
+		return netip.AddrPort{}, err
+	} else if ok {
+		return netip.AddrPortFrom(registry.Addr().Addr(), port), nil
+	}
+	return minidisc.ResolveRemoteAddr(s.Address)
+}
+
+// sameExceptLabels returns whether a and b only differ in their labels, if at
+// all.
+func sameExceptLabels(a, b Service) bool {
+	return a.Name == b.Name &&
+		a.Address == b.Address &&
+		slices.Equal(a.Aliases, b.Aliases) &&
+		a.Scheme == b.Scheme &&
+		a.GRPCConfig == b.GRPCConfig &&
+		maps.Equal(a.Annotations, b.Annotations)
+}
+
+// readConfigs reads and merges the config files at paths. Directories are
+// expanded to the *.yaml files they contain. No two services may share a name
+// or an address, whether they're in the same file or not.
+func readConfigs(paths []string) (*Config, error) {
+	var files []string
+	for _, path := range paths {
+		if path == "-" {
+			files = append(files, "/dev/stdin")
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.yaml"))
+		if err != nil {
+			return nil, err
+		}
+		slices.Sort(matches)
+		files = append(files, matches...)
+	}
+
+	merged := &Config{}
+	nameSources := make(map[string]string)
+	addrSources := make(map[string]string)
+	for _, file := range files {
+		cfg, err := readConfig(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		for _, s := range cfg.Services {
+			if src, ok := nameSources[s.Name]; ok {
+				return nil, duplicateError("Service", s.Name, src, file)
+			}
+			if src, ok := addrSources[addrKey(s.Address)]; ok {
+				return nil, duplicateError("Address", s.Address, src, file)
+			}
+			nameSources[s.Name] = file
+			addrSources[addrKey(s.Address)] = file
+		}
+		merged.Services = append(merged.Services, cfg.Services...)
+	}
+	return merged, nil
+}
+
+// duplicateError reports a name or address that's defined in both src and
+// file, which may be the same.
+func duplicateError(what, value, src, file string) error {
+	if src == file {
+		return fmt.Errorf("%s '%s' used more than once in %s", what, value, file)
+	}
+	return fmt.Errorf("%s '%s' used in both %s and %s", what, value, src, file)
 }
 
 func readConfig(path string) (*Config, error) {
@@ -178,14 +735,141 @@ func readConfig(path string) (*Config, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	if err := cfg.expandEnv(); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
-func parsePort(addr string) uint16 {
-	addr = addr[1:len(addr)] // Remove leading :
-	port, err := strconv.ParseUint(addr, 10, 16)
-	if err != nil {
-		log.Fatalf("Bad address '%s'", addr)
+// expandEnv replaces environment variable references in all string fields.
+func (cfg *Config) expandEnv() error {
+	var err error
+	expand := func(s string) string {
+		if err != nil {
+			return s
+		}
+		var exp string
+		exp, err = expandEnv(s)
+		return exp
+	}
+	for i := range cfg.Services {
+		s := &cfg.Services[i]
+		s.Name = expand(s.Name)
+		for j, alias := range s.Aliases {
+			s.Aliases[j] = expand(alias)
+		}
+		s.Address = expand(s.Address)
+		s.Scheme = expand(s.Scheme)
+		s.GRPCConfig = expand(s.GRPCConfig)
+		for k, v := range s.Labels {
+			s.Labels[k] = expand(v)
+		}
+		for k, v := range s.Annotations {
+			s.Annotations[k] = expand(v)
+		}
+	}
+	return err
+}
+
+var envRefRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// expandEnv replaces ${VAR} with the value of the environment variable VAR,
+// and ${VAR:-default} with either that value or, if it's unset or empty, with
+// default. Referencing an unset variable without default is an error.
+func expandEnv(s string) (string, error) {
+	var err error
+	result := envRefRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		m := envRefRegexp.FindStringSubmatch(ref)
+		name, fallback := m[1], m[2]
+		value, ok := os.LookupEnv(name)
+		if fallback != "" {
+			if value == "" {
+				value = fallback[2:] // Skip leading :-
+			}
+		} else if !ok && err == nil {
+			err = fmt.Errorf("Environment variable %s is not set", name)
+		}
+		return value
+	})
+	return result, err
+}
+
+// checkConfig validates all services in cfg without advertising them, and
+// prints a report. It returns the exit code for the process.
+func checkConfig(cfg *Config) int {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	failed := 0
+	seen := make(map[string]bool)
+	for _, s := range cfg.Services {
+		err := validateService(s)
+		key := addrKey(s.Address)
+		if err == nil && seen[key] {
+			err = fmt.Errorf("Address %s used more than once", s.Address)
+		}
+		seen[key] = true
+		if err == nil {
+			fmt.Fprintf(tw, "OK\t%s\t%s\t\n", s.Name, s.Address)
+		} else {
+			fmt.Fprintf(tw, "ERROR\t%s\t%s\t%v\n", s.Name, s.Address, err)
+			failed++
+		}
+	}
+	tw.Flush()
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d services are invalid\n", failed, len(cfg.Services))
+		return exitFailure
+	}
+	return 0
+}
+
+// validateService checks a service from the config the same way advertising
+// it would.
+func validateService(s Service) error {
+	if s.Name == "" {
+		return fmt.Errorf("Missing service name")
+	}
+	if _, ok, err := parseLocalAddr(s.Address); ok || err != nil {
+		return err
+	}
+	_, err := minidisc.ResolveRemoteAddr(s.Address)
+	return err
+}
+
+// addrKey returns the address of a service from the config in a normal form,
+// so that different ways to write the same address compare equal. Invalid
+// addresses are returned as they are.
+func addrKey(addr string) string {
+	if port, ok, err := parseLocalAddr(addr); err != nil {
+		return addr
+	} else if ok {
+		return fmt.Sprintf(":%d", port)
+	}
+	if ap, err := minidisc.ResolveRemoteAddr(addr); err == nil {
+		return ap.String()
+	}
+	return addr
+}
+
+// localHosts are the hosts in service addresses that mean the local host's
+// Tailnet address, as does omitting the host.
+var localHosts = []string{"", "0.0.0.0", "localhost"}
+
+// parseLocalAddr parses the address of a service on the local host: a bare
+// port, or a port with a host from localHosts. The bool is false if addr is a
+// remote address instead.
+func parseLocalAddr(addr string) (uint16, bool, error) {
+	portStr := addr
+	if host, p, err := net.SplitHostPort(addr); err == nil {
+		if !slices.Contains(localHosts, strings.ToLower(host)) {
+			return 0, false, nil
+		}
+		portStr = p
+	} else if strings.Contains(addr, ":") {
+		return 0, false, fmt.Errorf("Bad address '%s'", addr)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return 0, true, fmt.Errorf("Bad address '%s'", addr)
 	}
-	return uint16(port)
+	return uint16(port), true, nil
 }
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mscheidegger/minidisc/go/pkg/minidisc"
+)
+
+// mdArgsEnv, if set, makes the test binary run md with the arguments in it,
+// separated by newlines, instead of the tests. See runMD.
+const mdArgsEnv = "MD_TEST_ARGS"
+
+// mdTestPort is the registry port that md runs against in runMD.
+const mdTestPort = "28044"
+
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv(mdArgsEnv); ok {
+		runMain(strings.Split(args, "\n"))
+	}
+	os.Exit(m.Run())
+}
+
+// runMain advertises test services on a static Tailnet of just this host, and
+// then runs md with args. It doesn't return.
+func runMain(args []string) {
+	local := netip.MustParseAddr("127.0.0.81")
+	minidisc.SetStaticTailnet(local, nil)
+	r, err := minidisc.StartRegistryWithOptions(minidisc.StartRegistryOptions{
+		Port:            28044,
+		StaticLocalAddr: local,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(99)
+	}
+	r.AdvertiseService(8080, "web", map[string]string{"env": "prod"})
+	r.AdvertiseService(8081, "web", map[string]string{"env": "dev"})
+	r.AdvertiseUnixService("/run/web.sock", "websock", nil)
+	os.Args = append([]string{"md"}, args...)
+	main()
+	os.Exit(0)
+}
+
+// runMD runs md with args in a subprocess, see runMain, and returns its output
+// and exit code.
+func runMD(t *testing.T, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), mdArgsEnv+"="+strings.Join(args, "\n"))
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("Running md failed: %v", err)
+	}
+	if code == 99 {
+		t.Fatalf("Setting up md failed: %s", errOut.String())
+	}
+	return out.String(), errOut.String(), code
+}
+
+// startTestRegistry starts a registry on a loopback address that no other test
+// uses, so it becomes the leader.
+func startTestRegistry(t *testing.T) *minidisc.Registry {
+	t.Helper()
+	r, err := minidisc.StartRegistryWithOptions(minidisc.StartRegistryOptions{
+		Port:            28034,
+		StaticLocalAddr: netip.MustParseAddr("127.0.0.80"),
+	})
+	if err != nil {
+		t.Fatalf("StartRegistryWithOptions failed: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestReloadConfig(t *testing.T) {
+	web := Service{Name: "web", Address: ":8080", Labels: map[string]string{"env": "prod"}}
+	db := Service{Name: "db", Address: "100.64.0.1:5432"}
+	relabeled := web
+	relabeled.Labels = map[string]string{"env": "dev"}
+	moved := web
+	moved.Address = ":8081"
+	cases := []struct {
+		title  string
+		oldCfg []Service
+		newCfg []Service
+		// Expected services as "name address labels", and whether web kept its
+		// original registration.
+		want     []string
+		keepsWeb bool
+	}{
+		{"added", []Service{web}, []Service{web, db}, []string{
+			"db 100.64.0.1:5432 map[]", "web 127.0.0.80:8080 map[env:prod]",
+		}, true},
+		{"removed", []Service{web, db}, []Service{web}, []string{
+			"web 127.0.0.80:8080 map[env:prod]",
+		}, true},
+		{"only labels changed", []Service{web, db}, []Service{relabeled, db}, []string{
+			"db 100.64.0.1:5432 map[]", "web 127.0.0.80:8080 map[env:dev]",
+		}, true},
+		{"address changed", []Service{web}, []Service{moved}, []string{
+			"web 127.0.0.80:8081 map[env:prod]",
+		}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			r := startTestRegistry(t)
+			for _, s := range c.oldCfg {
+				if err := advertiseService(r, s); err != nil {
+					t.Fatalf("advertiseService failed: %v", err)
+				}
+			}
+			webBefore := findLocal(r, "web")
+			applied := reloadConfig(r, &Config{Services: c.oldCfg}, &Config{Services: c.newCfg})
+			if !reflect.DeepEqual(applied.Services, c.newCfg) {
+				t.Errorf("Expected applied config %v, got %v", c.newCfg, applied.Services)
+			}
+			var got []string
+			for _, s := range r.LocalServices() {
+				got = append(got, s.Name+" "+s.AddrPort.String()+" "+fmt.Sprint(s.Labels))
+			}
+			slices.Sort(got)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Expected services %v, got %v", c.want, got)
+			}
+			webAfter := findLocal(r, "web")
+			if kept := webAfter.RegisteredAt.Equal(webBefore.RegisteredAt); kept != c.keepsWeb {
+				t.Errorf("Expected web to keep its registration: %v, got %v", c.keepsWeb, kept)
+			}
+		})
+	}
+}
+
+// findLocal returns the local service of registry r with the given name.
+func findLocal(r *minidisc.Registry, name string) minidisc.Service {
+	i := slices.IndexFunc(r.LocalServices(), func(s minidisc.Service) bool { return s.Name == name })
+	if i < 0 {
+		return minidisc.Service{}
+	}
+	return r.LocalServices()[i]
+}
+
+func TestReadConfigs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a := write("a.yaml", "services:\n  - {name: a, address: ':1000'}\n")
+	b := write("b.yaml", "services:\n  - {name: b, address: ':2000'}\n")
+	sameName := write("same-name.yml", "services:\n  - {name: c, address: ':3000'}\n  - {name: c, address: ':3001'}\n")
+	sameAddr := write("same-addr.yml", "services:\n  - {name: d, address: ':4000'}\n  - {name: e, address: '4000'}\n")
+	otherA := write("other-a.yml", "services:\n  - {name: a, address: ':5000'}\n")
+	cases := []struct {
+		title   string
+		paths   []string
+		want    []string
+		wantErr bool
+	}{
+		{"files", []string{a, b}, []string{"a", "b"}, false},
+		{"directory", []string{dir}, []string{"a", "b"}, false},
+		{"name twice in a file", []string{sameName}, nil, true},
+		{"address twice in a file", []string{sameAddr}, nil, true},
+		{"name in two files", []string{a, otherA}, nil, true},
+		{"file twice", []string{a, a}, nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			cfg, err := readConfigs(c.paths)
+			if c.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got %v", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readConfigs failed: %v", err)
+			}
+			var names []string
+			for _, s := range cfg.Services {
+				names = append(names, s.Name)
+			}
+			if !reflect.DeepEqual(names, c.want) {
+				t.Errorf("Expected services %v, got %v", c.want, names)
+			}
+		})
+	}
+}
+
+func TestCheckConfigDuplicates(t *testing.T) {
+	cases := []struct {
+		title string
+		addrs []string
+		want  int
+	}{
+		{"distinct", []string{":8080", "8081", "100.64.0.1:8080"}, 0},
+		{"port and colon port", []string{":8080", "8080"}, exitFailure},
+		{"any and localhost", []string{"0.0.0.0:8080", "LOCALHOST:8080"}, exitFailure},
+		{"remote twice", []string{"100.64.0.1:80", "100.64.0.1:80"}, exitFailure},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			cfg := &Config{}
+			for i, addr := range c.addrs {
+				cfg.Services = append(cfg.Services, Service{Name: fmt.Sprint("s", i), Address: addr})
+			}
+			if got := checkConfig(cfg); got != c.want {
+				t.Errorf("Expected exit code %d, got %d", c.want, got)
+			}
+		})
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("MD_TEST_SET", "value")
+	t.Setenv("MD_TEST_EMPTY", "")
+	cases := []struct {
+		title   string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"no references", "plain $HOME", "plain $HOME", false},
+		{"set", "a-${MD_TEST_SET}-b", "a-value-b", false},
+		{"empty", "${MD_TEST_EMPTY}", "", false},
+		{"unset", "${MD_TEST_UNSET}", "", true},
+		{"default for unset", "${MD_TEST_UNSET:-fallback}", "fallback", false},
+		{"default for empty", "${MD_TEST_EMPTY:-fallback}", "fallback", false},
+		{"default unused", "${MD_TEST_SET:-fallback}", "value", false},
+		{"empty default", "${MD_TEST_UNSET:-}", "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			got, err := expandEnv(c.in)
+			if c.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandEnv failed: %v", err)
+			}
+			if got != c.want {
+				t.Errorf("Expected %q, got %q", c.want, got)
+			}
+		})
+	}
+}
+
+func TestConfigExpandEnv(t *testing.T) {
+	t.Setenv("MD_TEST_SET", "x")
+	cfg := &Config{Services: []Service{{
+		Name:        "name-${MD_TEST_SET}",
+		Aliases:     []string{"alias-${MD_TEST_SET}"},
+		Address:     ":${MD_TEST_PORT:-8080}",
+		Labels:      map[string]string{"label": "${MD_TEST_SET}"},
+		Annotations: map[string]string{"annotation": "${MD_TEST_SET}"},
+		Scheme:      "${MD_TEST_SCHEME:-grpc}",
+		GRPCConfig:  `{"x": "${MD_TEST_SET}"}`,
+	}}}
+	if err := cfg.expandEnv(); err != nil {
+		t.Fatalf("expandEnv failed: %v", err)
+	}
+	want := Service{
+		Name:        "name-x",
+		Aliases:     []string{"alias-x"},
+		Address:     ":8080",
+		Labels:      map[string]string{"label": "x"},
+		Annotations: map[string]string{"annotation": "x"},
+		Scheme:      "grpc",
+		GRPCConfig:  `{"x": "x"}`,
+	}
+	if !reflect.DeepEqual(cfg.Services[0], want) {
+		t.Errorf("Expected %+v, got %+v", want, cfg.Services[0])
+	}
+	cfg = &Config{Services: []Service{{Name: "s", Address: "${MD_TEST_UNSET}"}}}
+	if err := cfg.expandEnv(); err == nil {
+		t.Errorf("Expected error for unset variable")
+	}
+}
+
+func TestParseLocalAddr(t *testing.T) {
+	cases := []struct {
+		addr      string
+		wantPort  uint16
+		wantLocal bool
+		wantErr   bool
+	}{
+		{"8080", 8080, true, false},
+		{":8080", 8080, true, false},
+		{"0.0.0.0:8080", 8080, true, false},
+		{"localhost:8080", 8080, true, false},
+		{"LocalHost:8080", 8080, true, false},
+		{"100.64.0.1:8080", 0, false, false},
+		{"printer:631", 0, false, false},
+		{"0", 0, true, true},
+		{":0", 0, true, true},
+		{"65536", 0, true, true},
+		{"http", 0, true, true},
+		{"", 0, true, true},
+		{"1:2:3", 0, false, true},
+	}
+	for _, c := range cases {
+		t.Run(c.addr, func(t *testing.T) {
+			port, local, err := parseLocalAddr(c.addr)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("Expected error: %v, got %v", c.wantErr, err)
+			}
+			if port != c.wantPort || local != c.wantLocal {
+				t.Errorf(
+					"Expected (%d, %v), got (%d, %v)", c.wantPort, c.wantLocal, port, local,
+				)
+			}
+		})
+	}
+}
+
+func TestListOrders(t *testing.T) {
+	now := time.Now()
+	ss := []minidisc.Service{
+		{Name: "b", AddrPort: netip.MustParseAddrPort("100.64.0.1:80"), RegisteredAt: now.Add(-time.Hour)},
+		{Name: "a", AddrPort: netip.MustParseAddrPort("100.64.0.2:80")},
+		{Name: "c", Target: "unix:///run/c.sock", RegisteredAt: now},
+		{Name: "a", AddrPort: netip.MustParseAddrPort("100.64.0.1:81"), RegisteredAt: now.Add(-time.Minute)},
+	}
+	cases := []struct {
+		key  string
+		want []string
+	}{
+		// Ties keep the input order.
+		{"name", []string{"a 100.64.0.2:80", "a 100.64.0.1:81", "b 100.64.0.1:80", "c unix:///run/c.sock"}},
+		// Services without an address sort first, by target.
+		{"address", []string{"c unix:///run/c.sock", "b 100.64.0.1:80", "a 100.64.0.1:81", "a 100.64.0.2:80"}},
+		// Newest first, services without a time last.
+		{"age", []string{"c unix:///run/c.sock", "a 100.64.0.1:81", "b 100.64.0.1:80", "a 100.64.0.2:80"}},
+	}
+	for _, c := range cases {
+		t.Run(c.key, func(t *testing.T) {
+			sorted := slices.Clone(ss)
+			slices.SortStableFunc(sorted, listOrders[c.key])
+			var got []string
+			for _, s := range sorted {
+				got = append(got, s.Name+" "+fmtAddr(s))
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Expected %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestGroupServices(t *testing.T) {
+	ss := []minidisc.Service{
+		{Name: "web", Labels: map[string]string{"env": "prod"}},
+		{Name: "db", Labels: map[string]string{}},
+		{Name: "web", Labels: map[string]string{"env": "dev"}},
+		{Name: "cache", Labels: map[string]string{"env": "prod"}},
+	}
+	cases := []struct {
+		key  string
+		want []string
+	}{
+		{"name", []string{"cache: cache", "db: db", "web: web web"}},
+		{"env", []string{"env=dev: web", "env=prod: web cache", "(none): db"}},
+		{"missing", []string{"(none): web db web cache"}},
+	}
+	for _, c := range cases {
+		t.Run(c.key, func(t *testing.T) {
+			var got []string
+			for _, g := range groupServices(ss, c.key) {
+				var names []string
+				for _, s := range g.services {
+					names = append(names, s.Name)
+				}
+				got = append(got, g.title+": "+strings.Join(names, " "))
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Expected %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestFindOutput(t *testing.T) {
+	cases := []struct {
+		title string
+		args  []string
+		want  string
+	}{
+		{"name", []string{"web"}, "127.0.0.81:8080\n"},
+		{"labels", []string{"web", "env=dev"}, "127.0.0.81:8081\n"},
+		{"pattern", []string{"we?"}, "127.0.0.81:8080\n127.0.0.81:8081\n"},
+		{"quiet pattern", []string{"-q", "web*"}, "127.0.0.81:8080\n"},
+		{"quiet without TCP service", []string{"-q", "websock*"}, ""},
+		{"quiet not found", []string{"-q", "nope"}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			args := append([]string{"find", "--port", mdTestPort}, c.args...)
+			stdout, _, _ := runMD(t, args...)
+			if stdout != c.want {
+				t.Errorf("Expected output %q, got %q", c.want, stdout)
+			}
+		})
+	}
+}
+
+func TestListOutput(t *testing.T) {
+	stdout, _, code := runMD(t, "list", "--port", mdTestPort, "--group-by", "env")
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	var got []string
+	for _, line := range lines {
+		got = append(got, strings.Join(strings.Fields(line), " "))
+	}
+	want := []string{
+		"env=dev:", "* web 127.0.0.81:8081 { env=dev }",
+		"",
+		"env=prod:", "* web 127.0.0.81:8080 { env=prod }",
+		"",
+		"(none):", "* websock unix:///run/web.sock {}",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d lines, got %q", len(want), stdout)
+	}
+	for i := range want {
+		// Ignore the age, which comes last.
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("Expected line %d to start with %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestFindExitCodes(t *testing.T) {
+	cases := []struct {
+		title      string
+		args       []string
+		wantCode   int
+		wantStderr bool
+	}{
+		{"found", []string{"web"}, 0, false},
+		{"not found", []string{"nope"}, exitFailure, true},
+		{"quiet not found", []string{"-q", "nope"}, exitFailure, false},
+		{"error", []string{"--regexp", "("}, exitFindError, true},
+		{"usage", []string{}, exitUsage, true},
+		{"bad label", []string{"web", "env"}, exitUsage, true},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			args := append([]string{"find", "--port", mdTestPort}, c.args...)
+			_, stderr, code := runMD(t, args...)
+			if code != c.wantCode {
+				t.Errorf("Expected exit code %d, got %d", c.wantCode, code)
+			}
+			if (stderr != "") != c.wantStderr {
+				t.Errorf("Expected error output: %v, got %q", c.wantStderr, stderr)
+			}
+		})
+	}
+}
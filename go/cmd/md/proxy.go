@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mscheidegger/minidisc/go/pkg/minidisc"
+)
+
+// proxyDomain is the pseudo domain that requests to the proxy can use to name
+// the service, e.g. "Host: myservice.minidisc".
+const proxyDomain = ".minidisc"
+
+// proxyRefresh is how often the proxy refreshes its snapshot of the services.
+const proxyRefresh = 5 * time.Second
+
+func proxy(params []string) {
+	flags := flag.NewFlagSet("proxy", flag.ExitOnError)
+	port := portFlag(flags)
+	flags.Parse(params)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "'proxy' takes 1 parameter")
+		os.Exit(exitUsage)
+	}
+	addr := flags.Arg(0)
+	log.Printf("Proxying HTTP requests on %s", addr)
+	cache := minidisc.NewCacheWithOptions(proxyRefresh, minidisc.QueryOptions{Port: port()})
+	defer cache.Close()
+	log.Fatal(http.ListenAndServe(addr, newProxyHandler(cache)))
+}
+
+// proxyTargetKey is the context key for the backend URL of a request.
+type proxyTargetKey struct{}
+
+// newProxyHandler returns a handler that forwards requests to the service named
+// by their Host header or, failing that, by the first segment of their path,
+// which is then stripped. Services are looked up in cache, so requests don't
+// query the Tailnet.
+func newProxyHandler(cache *minidisc.Cache) http.Handler {
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(pr.In.Context().Value(proxyTargetKey{}).(*url.URL))
+			pr.SetXForwarded()
+		},
+	}
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		name, path, ok := proxyRoute(req)
+		if !ok {
+			http.Error(wrt, "No service given in host or path", http.StatusNotFound)
+			return
+		}
+		target, ok := proxyTarget(cache.Services(), name)
+		if !ok {
+			if err := cache.Err(); err != nil && cache.LastRefresh().IsZero() {
+				http.Error(wrt, err.Error(), http.StatusBadGateway)
+				return
+			}
+			err := fmt.Errorf("%w for %s", minidisc.ErrServiceNotFound, name)
+			http.Error(wrt, err.Error(), http.StatusNotFound)
+			return
+		}
+		ctx := context.WithValue(req.Context(), proxyTargetKey{}, target)
+		req = req.WithContext(ctx)
+		if path != req.URL.Path {
+			req.URL.Path = path
+			req.URL.RawPath = ""
+		}
+		rp.ServeHTTP(wrt, req)
+	})
+}
+
+// proxyTarget returns the URL of the first TCP service in ss named name,
+// ignoring case like DNS does, since proxyRoute lowercases host names. It uses
+// https for services advertised with that scheme, and http otherwise.
+func proxyTarget(ss []minidisc.Service, name string) (*url.URL, bool) {
+	match := minidisc.MatchOptions{CaseInsensitive: true}
+	for _, s := range ss {
+		if s.AddrPort.IsValid() && match.Matches(s, name, nil) {
+			scheme := "http"
+			if s.Scheme == "https" {
+				scheme = "https"
+			}
+			return &url.URL{Scheme: scheme, Host: s.AddrPort.String()}, true
+		}
+	}
+	return nil, false
+}
+
+// proxyRoute returns the name of the service a request is for, and the path to
+// forward it to.
+func proxyRoute(req *http.Request) (name, path string, ok bool) {
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if name, ok := strings.CutSuffix(host, proxyDomain); ok && name != "" {
+		return name, req.URL.Path, true
+	}
+	name, rest, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if name == "" {
+		return "", "", false
+	}
+	return name, "/" + rest, true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/mscheidegger/minidisc/go/pkg/minidisc"
+)
+
+func TestProxyRoute(t *testing.T) {
+	cases := []struct {
+		title  string
+		host   string
+		path   string
+		name   string
+		fwd    string
+		wantOK bool
+	}{
+		{"host", "myservice.minidisc", "/api/x", "myservice", "/api/x", true},
+		{"host with port", "myservice.minidisc:8080", "/", "myservice", "/", true},
+		{"host is case-insensitive", "MyService.Minidisc", "/", "myservice", "/", true},
+		{"path", "proxy.example", "/myservice/api/x", "myservice", "/api/x", true},
+		{"path without rest", "proxy.example", "/myservice", "myservice", "/", true},
+		{"bare domain uses path", "minidisc", "/myservice/x", "myservice", "/x", true},
+		{"empty host name uses path", ".minidisc", "/myservice/x", "myservice", "/x", true},
+		{"no service", "proxy.example", "/", "", "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://"+c.host+c.path, nil)
+			name, path, ok := proxyRoute(req)
+			if ok != c.wantOK || name != c.name || path != c.fwd {
+				t.Errorf(
+					"Expected (%q, %q, %v), got (%q, %q, %v)",
+					c.name, c.fwd, c.wantOK, name, path, ok,
+				)
+			}
+		})
+	}
+}
+
+func TestProxyTarget(t *testing.T) {
+	ss := []minidisc.Service{
+		{Name: "unix", Target: "unix:///run/web.sock"},
+		{Name: "Web", AddrPort: netip.MustParseAddrPort("100.64.0.1:80")},
+		{Name: "secure", Scheme: "https", AddrPort: netip.MustParseAddrPort("100.64.0.2:443")},
+	}
+	cases := []struct {
+		title string
+		name  string
+		want  string
+	}{
+		{"case-insensitive", "web", "http://100.64.0.1:80"},
+		{"https", "secure", "https://100.64.0.2:443"},
+		{"not TCP", "unix", ""},
+		{"unknown", "nope", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			got := ""
+			if u, ok := proxyTarget(ss, c.name); ok {
+				got = u.String()
+			}
+			if got != c.want {
+				t.Errorf("Expected %q, got %q", c.want, got)
+			}
+		})
+	}
+}
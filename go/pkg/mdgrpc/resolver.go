@@ -5,77 +5,442 @@
 // or if you use labels
 //     minidisc://name?label1=value1&label2=value2
 //
+// Label keys and values are percent-encoded as in URL queries, so characters
+// like "&", "=", "+", "%" and spaces must be escaped, e.g. with
+// url.QueryEscape. An unescaped "+" means a space.
+//
+// Only services advertised with scheme "grpc" or "grpcs", or without a scheme,
+// are considered. To accept other schemes instead, pass them as a
+// comma-separated list in the reserved "scheme" parameter:
+//     minidisc://name?scheme=grpc
+//
+// If the service isn't advertised (yet), the resolver reports an error. With
+// the reserved "fallback" parameter, it uses a static address instead, until
+// the service is discovered:
+//     minidisc://name?fallback=100.64.0.5:443
+//
+// With the "minidiscs" scheme instead, the resolver also sets each address's
+// ServerName to the MagicDNS name of the node serving it, so TLS certificates
+// issued for that name verify even though the connection goes to its IP:
+//     minidiscs://name
+//
+// Services advertised with a gRPC service config (see minidisc.WithGRPCConfig)
+// pass it on to the client, e.g. to select the load balancing policy.
+//
 // To use, just call mdgrpc.RegisterResolver() before creating any gRPC client
-// connections.
+// connections, or RegisterResolverWithOptions to customize it. The resolver
+// logs through the logger set with minidisc.SetLogger, and traces lookups with
+// the tracer set with minidisc.SetTracer.
 //
 // This is experimental, as is the gRPC resolver API it uses.
 
 package mdgrpc
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/mscheidegger/minidisc/go/pkg/minidisc"
 	"google.golang.org/grpc/resolver"
 )
 
+// ResolverOptions customizes the resolver. The zero value gives the behavior of
+// RegisterResolver.
+type ResolverOptions struct {
+	// RefreshInterval, if set, makes resolvers look up their target again
+	// periodically, to pick up services that moved. Zero means only when gRPC
+	// asks for it.
+	RefreshInterval time.Duration
+	// Timeout for the query to each registry. Zero means the timeout set with
+	// minidisc.SetQueryTimeout.
+	Timeout time.Duration
+	// Scheme is the URL scheme to register the resolver for, in case
+	// "minidisc" clashes with another resolver. The TLS variant is registered
+	// for the same scheme with an "s" appended. Empty means "minidisc".
+	Scheme string
+}
+
+// DefaultResolverScheme is the URL scheme RegisterResolver uses.
+const DefaultResolverScheme = "minidisc"
+
+// RegisterResolver registers the resolver for "minidisc://" and "minidiscs://"
+// targets.
 func RegisterResolver() {
-	resolver.Register(&minidiscResolverBuilder{})
+	RegisterResolverWithOptions(ResolverOptions{})
+}
+
+// RegisterResolverWithOptions is like RegisterResolver, but allows customizing
+// the resolver's behavior.
+func RegisterResolverWithOptions(opts ResolverOptions) {
+	if opts.Scheme == "" {
+		opts.Scheme = DefaultResolverScheme
+	}
+	resolver.Register(&minidiscResolverBuilder{opts: opts})
+	resolver.Register(&minidiscResolverBuilder{opts: opts, secure: true})
 }
 
 type minidiscResolverBuilder struct {
 	resolver.Builder
+
+	opts ResolverOptions
+	// Whether to set the TLS server name on resolved addresses.
+	secure bool
 }
 
 func (mrb *minidiscResolverBuilder) Build(
 	tgt resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions,
 ) (resolver.Resolver, error) {
-	name := tgt.URL.Host
-	labels := make(map[string]string)
-	q := tgt.URL.Query()
-	for key, _ := range q {
-		labels[key] = q.Get(key)
+	spec, err := parseTarget(tgt.URL)
+	if err != nil {
+		minidisc.GetLogger().Warnf("Bad resolver target %s: %v", tgt.URL.String(), err)
+		return nil, err
 	}
+	minidisc.GetLogger().Debugf(
+		"Building resolver for %s, labels: %v, schemes: %v",
+		spec.name, spec.labels, spec.schemes,
+	)
 	r := &minidiscResolver{
-		name:       name,
-		labels:     labels,
+		name:       spec.name,
+		labels:     spec.labels,
+		schemes:    spec.schemes,
+		fallback:   spec.fallback,
+		secure:     mrb.secure,
+		timeout:    mrb.opts.Timeout,
 		clientConn: cc,
+		stop:       make(chan struct{}),
 	}
+	r.resolve = r.lookup
 	go func() {
 		// Kick off first resolution at construction time. gRPC will apparently
 		// only do it after this initial attempt.
 		r.ResolveNow(resolver.ResolveNowOptions{})
 	}()
+	if mrb.opts.RefreshInterval > 0 {
+		go r.refresh(mrb.opts.RefreshInterval)
+	}
 	return r, nil
 }
 
+// targetSpec is what a resolver target URL asks for.
+type targetSpec struct {
+	name     string
+	labels   map[string]string
+	schemes  []string // Accepted service schemes.
+	fallback string   // Static "host:port" address, if any.
+}
+
+// parseTarget parses a resolver target URL.
+func parseTarget(u url.URL) (*targetSpec, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("Missing service name in target %s", u.String())
+	}
+	// Parse the raw query ourselves, since URL.Query silently drops malformed
+	// parameters.
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("Bad labels in target %s: %v", u.String(), err)
+	}
+	spec := &targetSpec{
+		name:    u.Host,
+		labels:  make(map[string]string),
+		schemes: defaultSchemes,
+	}
+	if q.Has(schemeParam) {
+		spec.schemes = strings.Split(q.Get(schemeParam), ",")
+		q.Del(schemeParam)
+	}
+	if q.Has(fallbackParam) {
+		spec.fallback = q.Get(fallbackParam)
+		if _, _, err := net.SplitHostPort(spec.fallback); err != nil {
+			return nil, fmt.Errorf("Bad fallback address in target %s: %v", u.String(), err)
+		}
+		q.Del(fallbackParam)
+	}
+	for key, values := range q {
+		if key == "" {
+			return nil, fmt.Errorf("Empty label key in target %s", u.String())
+		}
+		if len(values) > 1 {
+			return nil, fmt.Errorf("Label %s repeated in target %s", key, u.String())
+		}
+		spec.labels[key] = values[0]
+	}
+	return spec, nil
+}
+
 func (mrb *minidiscResolverBuilder) Scheme() string {
-	return "minidisc"
+	if mrb.secure {
+		return mrb.opts.Scheme + "s"
+	}
+	return mrb.opts.Scheme
 }
 
+// Reserved target query parameters, which aren't matched as labels.
+const (
+	// Selects the accepted service schemes.
+	schemeParam = "scheme"
+	// Sets a static address to use while the service isn't found.
+	fallbackParam = "fallback"
+)
+
+// defaultSchemes are the service schemes accepted unless the target specifies
+// others. The empty scheme keeps services from before schemes existed working.
+var defaultSchemes = []string{"grpc", "grpcs", ""}
+
+// Bounds for the backoff between retries while the Tailnet is unavailable.
+const (
+	minRetryBackoff = 1 * time.Second
+	maxRetryBackoff = 30 * time.Second
+)
+
+// minResolveInterval limits how often a resolver queries the Tailnet, which
+// fans out to every registry on it. More frequent ResolveNow calls are
+// coalesced into one that runs when the interval is over.
+const minResolveInterval = 5 * time.Second
+
 type minidiscResolver struct {
 	resolver.Resolver
 
 	name       string
 	labels     map[string]string
+	schemes    []string
+	fallback   string
+	secure     bool
+	timeout    time.Duration
 	clientConn resolver.ClientConn
+	// Closed when the resolver is closed.
+	stop chan struct{}
+	// Looks up the target's address. Replaced in tests.
+	resolve func(ctx context.Context) (resolution, error)
+
+	// Serializes updates, so results are published in order.
+	updateMutex sync.Mutex
+
+	mutex       sync.Mutex
+	lastResolve time.Time     // Start of the last lookup.
+	published   bool          // Whether gRPC has our last result.
+	last        resolution    // Last published result.
+	timer       *time.Timer   // Pending lookup, if any.
+	backoff     time.Duration // Delay before the last retry.
+	closed      bool
 }
 
+// ResolveNow looks up the target and reports the result to gRPC, unless the
+// last lookup was less than minResolveInterval ago. In that case, the lookup is
+// deferred until the interval is over.
 func (mr *minidiscResolver) ResolveNow(_ resolver.ResolveNowOptions) {
-	addr, err := minidisc.FindService(mr.name, mr.labels)
+	mr.mutex.Lock()
+	wait := time.Until(mr.lastResolve.Add(minResolveInterval))
+	if wait > 0 {
+		mr.scheduleLocked(wait)
+		mr.mutex.Unlock()
+		minidisc.GetLogger().Debugf("Deferring resolution of %s by %v", mr.name, wait)
+		return
+	}
+	mr.mutex.Unlock()
+	mr.update()
+}
+
+// update looks up the target and reports the result to gRPC. If the service
+// doesn't exist, that's reported right away, and gRPC decides whether to try
+// again. If the Tailnet itself is unavailable, we report that, too, but also
+// retry on our own with exponential backoff, since that's usually transient.
+// Addresses are only published if they changed since the last update.
+func (mr *minidiscResolver) update() {
+	mr.updateMutex.Lock()
+	defer mr.updateMutex.Unlock()
+	mr.mutex.Lock()
+	mr.lastResolve = time.Now()
+	mr.mutex.Unlock()
+
+	logger := minidisc.GetLogger()
+	logger.Debugf("Resolving %s, labels: %v", mr.name, mr.labels)
+	ctx, span := minidisc.GetTracer().Start(context.Background(), "mdgrpc.Resolve")
+	defer span.End()
+	span.SetAttribute("minidisc.service", mr.name)
+	res, err := mr.resolve(ctx)
+	if errors.Is(err, minidisc.ErrServiceNotFound) && mr.fallback != "" {
+		logger.Infof("Cannot find %s, using fallback %s: %v", mr.name, mr.fallback, err)
+		res, err = resolution{address: mr.fallbackAddress()}, nil
+	}
+	if err != nil {
+		span.RecordError(err)
+	} else {
+		span.SetAttribute("minidisc.address", res.address.Addr)
+	}
 	if err != nil {
+		if errors.Is(err, minidisc.ErrTailnetUnavailable) {
+			backoff := mr.scheduleRetry()
+			logger.Warnf(
+				"Cannot resolve %s, labels: %v, retrying in %v: %v",
+				mr.name, mr.labels, backoff, err,
+			)
+		} else {
+			logger.Warnf("Cannot resolve %s, labels: %v: %v", mr.name, mr.labels, err)
+		}
+		mr.mutex.Lock()
+		mr.published = false
+		mr.mutex.Unlock()
 		mr.clientConn.ReportError(err)
 		return
 	}
-	mr.clientConn.UpdateState(resolver.State{
+	mr.mutex.Lock()
+	mr.backoff = 0
+	unchanged := mr.published && res == mr.last
+	mr.published = true
+	mr.last = res
+	mr.mutex.Unlock()
+	if unchanged {
+		logger.Debugf("Resolution of %s unchanged: %s", mr.name, res.address.Addr)
+		return
+	}
+	logger.Debugf(
+		"Resolved %s, labels: %v, to %s (server name %q)",
+		mr.name, mr.labels, res.address.Addr, res.address.ServerName,
+	)
+	state := resolver.State{
 		Endpoints: []resolver.Endpoint{
 			resolver.Endpoint{
-				Addresses: []resolver.Address{
-					resolver.Address{Addr: addr.String()},
-				},
+				Addresses: []resolver.Address{res.address},
 			},
 		},
+	}
+	if res.serviceConfig != "" {
+		sc := mr.clientConn.ParseServiceConfig(res.serviceConfig)
+		if sc.Err != nil {
+			logger.Warnf("Ignoring bad service config for %s: %v", mr.name, sc.Err)
+		} else {
+			state.ServiceConfig = sc
+		}
+	}
+	mr.clientConn.UpdateState(state)
+}
+
+// resolution is the result of looking up a target.
+type resolution struct {
+	address       resolver.Address
+	serviceConfig string // JSON gRPC service config, if any.
+}
+
+// lookup returns the gRPC address for the target.
+func (mr *minidiscResolver) lookup(ctx context.Context) (resolution, error) {
+	s, err := mr.find(ctx)
+	if err != nil {
+		return resolution{}, err
+	}
+	address := resolver.Address{Addr: s.AddrPort.String()}
+	if mr.secure {
+		hostname, err := minidisc.LookupHostname(s.AddrPort.Addr())
+		if err != nil {
+			return resolution{}, err
+		}
+		address.ServerName = hostname
+	}
+	return resolution{address: address, serviceConfig: s.GRPCConfig}, nil
+}
+
+// fallbackAddress returns the gRPC address for the target's fallback.
+func (mr *minidiscResolver) fallbackAddress() resolver.Address {
+	address := resolver.Address{Addr: mr.fallback}
+	if mr.secure {
+		host, _, _ := net.SplitHostPort(mr.fallback)
+		address.ServerName = host
+		if addr, err := netip.ParseAddr(host); err == nil {
+			if hostname, err := minidisc.LookupHostname(addr); err == nil {
+				address.ServerName = hostname
+			}
+		}
+	}
+	return address
+}
+
+// scheduleRetry arranges for another update after a backoff that doubles with
+// every consecutive failure, and returns that backoff.
+func (mr *minidiscResolver) scheduleRetry() time.Duration {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+	mr.backoff = nextBackoff(mr.backoff)
+	mr.scheduleLocked(mr.backoff)
+	return mr.backoff
+}
+
+// scheduleLocked arranges for an update after d, unless one is pending
+// already. mr.mutex must be held.
+func (mr *minidiscResolver) scheduleLocked(d time.Duration) {
+	if mr.closed || mr.timer != nil {
+		return
+	}
+	mr.timer = time.AfterFunc(d, func() {
+		mr.mutex.Lock()
+		mr.timer = nil
+		closed := mr.closed
+		mr.mutex.Unlock()
+		if !closed {
+			mr.update()
+		}
 	})
 }
 
+// refresh looks up the target every interval until the resolver is closed.
+func (mr *minidiscResolver) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mr.stop:
+			return
+		case <-ticker.C:
+			mr.ResolveNow(resolver.ResolveNowOptions{})
+		}
+	}
+}
+
+// nextBackoff returns the retry backoff that follows d.
+func nextBackoff(d time.Duration) time.Duration {
+	return min(max(2*d, minRetryBackoff), maxRetryBackoff)
+}
+
+// find returns the first service that matches the target's name
+// and labels, and has one of the accepted schemes.
+func (mr *minidiscResolver) find(ctx context.Context) (minidisc.Service, error) {
+	// Prefer local instances, like FindService.
+	opts := minidisc.QueryOptions{Timeout: mr.timeout, LocalFirst: true}
+	ss, err := minidisc.ListServicesContext(ctx, opts)
+	if err != nil {
+		return minidisc.Service{}, err
+	}
+	var match minidisc.MatchOptions // Exact match, like FindService.
+	for _, s := range ss {
+		if !match.Matches(s, mr.name, mr.labels) {
+			continue
+		}
+		if s.AddrPort.IsValid() && slices.Contains(mr.schemes, s.Scheme) {
+			return s, nil
+		}
+	}
+	return minidisc.Service{}, fmt.Errorf(
+		"%w for %s with an accepted scheme", minidisc.ErrServiceNotFound, mr.name,
+	)
+}
+
 func (mr *minidiscResolver) Close() {
-	// No-op
+	minidisc.GetLogger().Debugf("Closing resolver for %s", mr.name)
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+	if !mr.closed {
+		close(mr.stop)
+	}
+	mr.closed = true
+	if mr.timer != nil {
+		mr.timer.Stop()
+		mr.timer = nil
+	}
 }
@@ -0,0 +1,298 @@
+package mdgrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mscheidegger/minidisc/go/pkg/minidisc"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// fakeClientConn records what a resolver reports to gRPC.
+type fakeClientConn struct {
+	resolver.ClientConn
+
+	mutex   sync.Mutex
+	updates []resolver.State
+	errors  []error
+}
+
+func (cc *fakeClientConn) UpdateState(s resolver.State) error {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.updates = append(cc.updates, s)
+	return nil
+}
+
+func (cc *fakeClientConn) ReportError(err error) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.errors = append(cc.errors, err)
+}
+
+func (cc *fakeClientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
+	if !json.Valid([]byte(config)) {
+		return &serviceconfig.ParseResult{Err: errors.New("Invalid JSON")}
+	}
+	return &serviceconfig.ParseResult{Config: fakeServiceConfig{json: config}}
+}
+
+type fakeServiceConfig struct {
+	serviceconfig.Config
+
+	json string
+}
+
+// newTestResolver returns a resolver whose lookups return the results in
+// order. Results are addresses, resolutions or errors.
+func newTestResolver(cc *fakeClientConn, results ...any) *minidiscResolver {
+	mr := &minidiscResolver{
+		name: "svc", schemes: defaultSchemes, clientConn: cc, stop: make(chan struct{}),
+	}
+	mr.resolve = func(context.Context) (resolution, error) {
+		r := results[0]
+		results = results[1:]
+		switch r := r.(type) {
+		case error:
+			return resolution{}, r
+		case resolution:
+			return r, nil
+		default:
+			return resolution{address: resolver.Address{Addr: r.(string)}}, nil
+		}
+	}
+	return mr
+}
+
+func TestParseTarget(t *testing.T) {
+	cases := []struct {
+		title    string
+		target   string
+		labels   map[string]string
+		schemes  []string
+		fallback string
+		wantErr  bool
+	}{
+		{"no labels", "minidisc://svc", map[string]string{}, defaultSchemes, "", false},
+		{"plain labels", "minidisc://svc?env=prod&x=y", map[string]string{"env": "prod", "x": "y"}, defaultSchemes, "", false},
+		{"escaped space", "minidisc://svc?desc=a%20b", map[string]string{"desc": "a b"}, defaultSchemes, "", false},
+		{"plus is space", "minidisc://svc?desc=a+b", map[string]string{"desc": "a b"}, defaultSchemes, "", false},
+		{"reserved characters", "minidisc://svc?q=%26%3D%2B%25", map[string]string{"q": "&=+%"}, defaultSchemes, "", false},
+		{"escaped key", "minidisc://svc?a%3Db=c", map[string]string{"a=b": "c"}, defaultSchemes, "", false},
+		{"scheme", "minidisc://svc?scheme=grpc,http&env=prod", map[string]string{"env": "prod"}, []string{"grpc", "http"}, "", false},
+		{"fallback", "minidisc://svc?fallback=100.64.0.5:443", map[string]string{}, defaultSchemes, "100.64.0.5:443", false},
+		{"bad fallback", "minidisc://svc?fallback=100.64.0.5", nil, nil, "", true},
+		{"bad escape", "minidisc://svc?desc=%zz", nil, nil, "", true},
+		{"repeated label", "minidisc://svc?env=prod&env=dev", nil, nil, "", true},
+		{"empty key", "minidisc://svc?=x", nil, nil, "", true},
+		{"missing name", "minidisc:///?env=prod", nil, nil, "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			u, err := url.Parse(c.target)
+			if err != nil {
+				t.Fatalf("Bad test target %s: %v", c.target, err)
+			}
+			spec, err := parseTarget(*u)
+			if c.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %s", c.target)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTarget failed: %v", err)
+			}
+			if spec.name != "svc" {
+				t.Errorf("Expected name svc, got %s", spec.name)
+			}
+			if !reflect.DeepEqual(spec.labels, c.labels) {
+				t.Errorf("Expected labels %v, got %v", c.labels, spec.labels)
+			}
+			if !reflect.DeepEqual(spec.schemes, c.schemes) {
+				t.Errorf("Expected schemes %v, got %v", c.schemes, spec.schemes)
+			}
+			if spec.fallback != c.fallback {
+				t.Errorf("Expected fallback %q, got %q", c.fallback, spec.fallback)
+			}
+		})
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	want := []time.Duration{
+		1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 30 * time.Second, 30 * time.Second,
+	}
+	var d time.Duration
+	for i, w := range want {
+		d = nextBackoff(d)
+		if d != w {
+			t.Errorf("Backoff %d: expected %v, got %v", i, w, d)
+		}
+	}
+}
+
+func TestResolverChangeDetection(t *testing.T) {
+	cc := &fakeClientConn{}
+	mr := newTestResolver(
+		cc, "100.64.0.1:80", "100.64.0.1:80", minidisc.ErrServiceNotFound,
+		"100.64.0.1:80", "100.64.0.2:80",
+	)
+	defer mr.Close()
+	for range 5 {
+		mr.update()
+	}
+	var addrs []string
+	for _, s := range cc.updates {
+		addrs = append(addrs, s.Endpoints[0].Addresses[0].Addr)
+	}
+	want := []string{"100.64.0.1:80", "100.64.0.1:80", "100.64.0.2:80"}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Errorf("Expected updates %v, got %v", want, addrs)
+	}
+	if len(cc.errors) != 1 || !errors.Is(cc.errors[0], minidisc.ErrServiceNotFound) {
+		t.Errorf("Expected one ErrServiceNotFound, got %v", cc.errors)
+	}
+}
+
+func TestResolverRateLimit(t *testing.T) {
+	cc := &fakeClientConn{}
+	mr := newTestResolver(cc, "100.64.0.1:80", "100.64.0.2:80")
+	defer mr.Close()
+	for range 3 {
+		mr.ResolveNow(resolver.ResolveNowOptions{})
+	}
+	if len(cc.updates) != 1 {
+		t.Errorf("Expected one update, got %v", cc.updates)
+	}
+	mr.mutex.Lock()
+	pending := mr.timer != nil
+	mr.mutex.Unlock()
+	if !pending {
+		t.Errorf("Expected deferred resolution to be scheduled")
+	}
+}
+
+func TestBuilderScheme(t *testing.T) {
+	cases := []struct {
+		scheme string
+		secure bool
+		want   string
+	}{
+		{DefaultResolverScheme, false, "minidisc"},
+		{DefaultResolverScheme, true, "minidiscs"},
+		{"disco", false, "disco"},
+		{"disco", true, "discos"},
+	}
+	for _, c := range cases {
+		mrb := &minidiscResolverBuilder{opts: ResolverOptions{Scheme: c.scheme}, secure: c.secure}
+		if got := mrb.Scheme(); got != c.want {
+			t.Errorf("Expected scheme %s, got %s", c.want, got)
+		}
+	}
+}
+
+func TestResolverFallback(t *testing.T) {
+	cc := &fakeClientConn{}
+	mr := newTestResolver(cc, minidisc.ErrServiceNotFound, "100.64.0.1:80")
+	mr.fallback = "100.64.0.5:443"
+	defer mr.Close()
+	mr.update()
+	mr.update()
+	var addrs []string
+	for _, s := range cc.updates {
+		addrs = append(addrs, s.Endpoints[0].Addresses[0].Addr)
+	}
+	want := []string{"100.64.0.5:443", "100.64.0.1:80"}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Errorf("Expected updates %v, got %v", want, addrs)
+	}
+	if len(cc.errors) != 0 {
+		t.Errorf("Expected no errors with fallback, got %v", cc.errors)
+	}
+}
+
+func TestResolverServiceConfig(t *testing.T) {
+	cc := &fakeClientConn{}
+	config := `{"loadBalancingConfig": [{"round_robin": {}}]}`
+	address := resolver.Address{Addr: "100.64.0.1:80"}
+	mr := newTestResolver(
+		cc,
+		resolution{address: address, serviceConfig: config},
+		resolution{address: address, serviceConfig: "{bad"},
+	)
+	defer mr.Close()
+	mr.update()
+	mr.update()
+	if len(cc.updates) != 2 {
+		t.Fatalf("Expected 2 updates, got %v", cc.updates)
+	}
+	sc := cc.updates[0].ServiceConfig
+	if sc == nil || sc.Config.(fakeServiceConfig).json != config {
+		t.Errorf("Expected service config %s, got %v", config, sc)
+	}
+	if cc.updates[1].ServiceConfig != nil {
+		t.Errorf("Expected bad service config to be dropped, got %v", cc.updates[1].ServiceConfig)
+	}
+}
+
+func TestResolverAliases(t *testing.T) {
+	minidisc.SetStaticTailnet(netip.MustParseAddr("127.0.0.70"), nil)
+	defer minidisc.SetStaticTailnet(netip.Addr{}, nil)
+	r, err := minidisc.StartRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	err = r.AdvertiseService(
+		5000, "payments", nil, minidisc.WithAliases("billing"), minidisc.WithScheme("grpc"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Services with other schemes are skipped, those without are accepted.
+	if err := r.AdvertiseService(5001, "web", nil, minidisc.WithScheme("http")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AdvertiseService(5002, "api", nil, minidisc.WithScheme("http")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AdvertiseService(5003, "api", nil); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"billing", "127.0.0.70:5000"},
+		{"web", ""},
+		{"api", "127.0.0.70:5003"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mr := &minidiscResolver{name: c.name, schemes: defaultSchemes}
+			s, err := mr.find(context.Background())
+			if c.want == "" {
+				if err == nil {
+					t.Errorf("Expected no match, got %v", s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolving %s failed: %v", c.name, err)
+			}
+			if want := netip.MustParseAddrPort(c.want); s.AddrPort != want {
+				t.Errorf("Expected %v, got %v", want, s.AddrPort)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+// Cache of ListServices results for clients that look up services often.
+package minidisc
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Cache keeps a snapshot of ListServices in memory and refreshes it in the
+// background. Lookups are served from the snapshot, so they are cheap enough
+// for hot paths, at the price of missing changes until the next refresh.
+//
+// If a refresh fails, the cache keeps the previous snapshot and reports the
+// error through Err.
+type Cache struct {
+	opts QueryOptions
+
+	// Held during Refresh, so snapshots are replaced in the order they were
+	// taken, and callbacks don't see an older one after a newer one.
+	refreshMutex sync.Mutex
+	mutex        sync.Mutex
+	services     []Service
+	lastRefresh  time.Time
+	lastErr      error
+	// Callbacks registered with OnChange, by ID for removal.
+	callbacks map[int]func(CacheChange)
+	nextID    int
+	// Held while calling callbacks, so they see changes in order.
+	notifyMutex sync.Mutex
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// DefaultCacheRefresh is how often a Cache refreshes if NewCache gets a
+// non-positive interval.
+const DefaultCacheRefresh = 30 * time.Second
+
+// NewCache creates a cache of ListServices that refreshes every refresh, or
+// every DefaultCacheRefresh if it's not positive. It fills the cache before
+// returning; if that fails, the cache starts out empty, Err returns the error,
+// and the next refresh tries again. Call Close to stop refreshing.
+func NewCache(refresh time.Duration) *Cache {
+	return NewCacheWithOptions(refresh, QueryOptions{})
+}
+
+// NewCacheWithOptions is like NewCache, but allows customizing the queries.
+func NewCacheWithOptions(refresh time.Duration, opts QueryOptions) *Cache {
+	if refresh <= 0 {
+		refresh = DefaultCacheRefresh
+	}
+	// Keep the order in which Find prefers services.
+	opts.LocalFirst = true
+	c := &Cache{opts: opts, stop: make(chan struct{})}
+	c.Refresh()
+	go c.refreshLoop(refresh)
+	return c
+}
+
+// refreshLoop calls Refresh every interval until the cache is closed.
+func (c *Cache) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Refresh()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Refresh updates the snapshot right away, e.g. after failing to connect to a
+// service found in the cache. It returns the error of ListServices, in which
+// case the previous snapshot stays.
+func (c *Cache) Refresh() error {
+	c.refreshMutex.Lock()
+	defer c.refreshMutex.Unlock()
+	ss, err := ListServicesWithOptions(c.opts)
+	c.notifyMutex.Lock()
+	defer c.notifyMutex.Unlock()
+	c.mutex.Lock()
+	c.lastErr = err
+	if err != nil {
+		c.mutex.Unlock()
+		logger.Warnf("Error refreshing service cache: %v", err)
+		return err
+	}
+	change := diffServices(c.services, ss)
+	c.services = ss
+	c.lastRefresh = time.Now()
+	callbacks := slices.Collect(maps.Values(c.callbacks))
+	c.mutex.Unlock()
+	if !change.empty() {
+		for _, f := range callbacks {
+			f(change)
+		}
+	}
+	return nil
+}
+
+// CacheChange tells OnChange callbacks how the services in a Cache changed.
+// A service whose details changed, e.g. its labels, is both removed in its old
+// form and added in its new one.
+type CacheChange struct {
+	Added   []Service
+	Removed []Service
+}
+
+// empty returns whether nothing changed.
+func (cc CacheChange) empty() bool {
+	return len(cc.Added) == 0 && len(cc.Removed) == 0
+}
+
+// diffServices returns the changes from the services in old to those in cur.
+func diffServices(old, cur []Service) CacheChange {
+	var change CacheChange
+	for _, s := range cur {
+		if !slices.ContainsFunc(old, s.Equal) {
+			change.Added = append(change.Added, s)
+		}
+	}
+	for _, s := range old {
+		if !slices.ContainsFunc(cur, s.Equal) {
+			change.Removed = append(change.Removed, s)
+		}
+	}
+	return change
+}
+
+// OnChange registers f to be called whenever a refresh changes the services in
+// the cache. Right away, it's called once with the current services as added,
+// so f sees every change from a known state. Calls are made one at a time, in
+// the order of the changes, from the goroutine that refreshed the cache; f
+// must not call Refresh or OnChange. The returned function unregisters f.
+func (c *Cache) OnChange(f func(CacheChange)) (remove func()) {
+	c.notifyMutex.Lock()
+	defer c.notifyMutex.Unlock()
+	c.mutex.Lock()
+	if c.callbacks == nil {
+		c.callbacks = make(map[int]func(CacheChange))
+	}
+	id := c.nextID
+	c.nextID++
+	c.callbacks[id] = f
+	current := slices.Clone(c.services)
+	c.mutex.Unlock()
+	if len(current) > 0 {
+		f(CacheChange{Added: current})
+	}
+	return func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		delete(c.callbacks, id)
+	}
+}
+
+// Services returns the whole snapshot, local services first like FindService
+// prefers them.
+func (c *Cache) Services() []Service {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return slices.Clone(c.services)
+}
+
+// Find is like FindService, but looks in the snapshot. If nothing matches, the
+// error wraps ErrServiceNotFound, unless the cache couldn't be filled so far, in
+// which case it's the error of the last refresh.
+func (c *Cache) Find(name string, labels map[string]string) (netip.AddrPort, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if ap, ok := firstMatch(c.services, name, labels); ok {
+		return ap, nil
+	}
+	if c.lastRefresh.IsZero() && c.lastErr != nil {
+		return netip.AddrPort{}, c.lastErr
+	}
+	return netip.AddrPort{}, fmt.Errorf("%w for %s", ErrServiceNotFound, name)
+}
+
+// LastRefresh returns when the snapshot was last refreshed successfully, or
+// the zero time if it never was.
+func (c *Cache) LastRefresh() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lastRefresh
+}
+
+// Err returns the error of the last refresh, or nil if it succeeded.
+func (c *Cache) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lastErr
+}
+
+// Close stops the background refresh. The snapshot stays available.
+func (c *Cache) Close() {
+	c.closeOnce.Do(func() { close(c.stop) })
+}
@@ -0,0 +1,158 @@
+package minidisc
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	c := NewCache(time.Hour)
+	defer c.Close()
+	if err := c.Err(); err != nil {
+		t.Fatalf("Initial refresh failed: %v", err)
+	}
+	if c.LastRefresh().IsZero() {
+		t.Errorf("Expected refresh time to be set")
+	}
+	if n := len(c.Services()); n != 4 {
+		t.Errorf("Expected 4 services, got %d", n)
+	}
+	ap, err := c.Find("bar", nil)
+	if want := netip.MustParseAddrPort("127.0.0.3:42"); err != nil || ap != want {
+		t.Errorf("Expected %v, got %v, %v", want, ap, err)
+	}
+
+	// New services only show up after a refresh.
+	if err := registry.AdvertiseService(4100, "cached", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.UnlistService(4100)
+	if _, err := c.Find("cached", nil); !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("Expected ErrServiceNotFound before refresh, got %v", err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Find("cached", nil); err != nil {
+		t.Errorf("Expected to find service after refresh, got %v", err)
+	}
+}
+
+func TestCacheBackgroundRefresh(t *testing.T) {
+	c := NewCache(20 * time.Millisecond)
+	defer c.Close()
+	if err := registry.AdvertiseService(4101, "refreshed", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.UnlistService(4101)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := c.Find("refreshed", nil); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Service didn't show up in the cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCacheDefaultRefresh(t *testing.T) {
+	// Non-positive intervals fall back to the default instead of panicking.
+	for _, refresh := range []time.Duration{0, -time.Second} {
+		c := NewCache(refresh)
+		c.Close()
+	}
+}
+
+func TestCacheErrors(t *testing.T) {
+	p := &flakyStatusProvider{}
+	p.failures.Store(1)
+	SetStatusProvider(p)
+	defer SetStatusProvider(fakeStatusProvider{})
+	c := NewCache(time.Hour)
+	defer c.Close()
+	if _, err := c.Find("bar", nil); !errors.Is(err, ErrTailnetUnavailable) {
+		t.Errorf("Expected ErrTailnetUnavailable from empty cache, got %v", err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed refresh keeps the snapshot.
+	p.failures.Store(1)
+	if err := c.Refresh(); !errors.Is(err, ErrTailnetUnavailable) {
+		t.Errorf("Expected ErrTailnetUnavailable, got %v", err)
+	}
+	if !errors.Is(c.Err(), ErrTailnetUnavailable) {
+		t.Errorf("Expected Err to return the refresh error, got %v", c.Err())
+	}
+	if _, err := c.Find("bar", nil); err != nil {
+		t.Errorf("Expected to find service in old snapshot, got %v", err)
+	}
+}
+
+func TestCacheOnChange(t *testing.T) {
+	c := NewCache(time.Hour)
+	defer c.Close()
+	var changes []CacheChange
+	remove := c.OnChange(func(cc CacheChange) { changes = append(changes, cc) })
+	if len(changes) != 1 || len(changes[0].Added) != 4 || len(changes[0].Removed) != 0 {
+		t.Fatalf("Expected initial change with 4 added services, got %v", changes)
+	}
+
+	// No change, no callback.
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 {
+		t.Errorf("Expected no callback without changes, got %v", changes[1:])
+	}
+
+	if err := registry.AdvertiseService(4102, "appeared", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || len(changes[1].Added) != 1 || changes[1].Added[0].Name != "appeared" ||
+		len(changes[1].Removed) != 0 {
+		t.Fatalf("Expected appeared to be added, got %v", changes[1:])
+	}
+
+	registry.UnlistService(4102)
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 || len(changes[2].Removed) != 1 || changes[2].Removed[0].Name != "appeared" ||
+		len(changes[2].Added) != 0 {
+		t.Fatalf("Expected appeared to be removed, got %v", changes[2:])
+	}
+
+	remove()
+	if err := registry.AdvertiseService(4103, "unnoticed", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.UnlistService(4103)
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Errorf("Expected no callback after removal, got %v", changes[3:])
+	}
+}
+
+func TestDiffServices(t *testing.T) {
+	a := Service{Name: "a", Labels: map[string]string{"env": "prod"}}
+	b := Service{Name: "b"}
+	a2 := Service{Name: "a", Labels: map[string]string{"env": "dev"}}
+	change := diffServices([]Service{a, b}, []Service{a2, b})
+	if len(change.Added) != 1 || !change.Added[0].Equal(a2) {
+		t.Errorf("Expected a2 added, got %v", change.Added)
+	}
+	if len(change.Removed) != 1 || !change.Removed[0].Equal(a) {
+		t.Errorf("Expected a removed, got %v", change.Removed)
+	}
+}
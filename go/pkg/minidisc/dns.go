@@ -0,0 +1,201 @@
+// A tiny DNS server, so that clients without Minidisc support can find services.
+package minidisc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DNSDomain is the pseudo top-level domain that ServeDNS answers for: a query
+// for "myservice.minidisc" returns the addresses of the services named
+// myservice.
+const DNSDomain = "minidisc"
+
+const (
+	// dnsTTL is how long, in seconds, clients may cache answers. It's short,
+	// since services come and go.
+	dnsTTL = 5
+	// dnsRefresh is how often ServeDNS refreshes its snapshot of the services.
+	// As clients cache answers for as long, fresher ones wouldn't help much.
+	dnsRefresh = dnsTTL * time.Second
+	// maxDNSQueries is how many queries ServeDNS answers in parallel. Others
+	// are dropped, and the client retries.
+	maxDNSQueries = 64
+	// maxDNSMessage is the largest query we read. Queries are far smaller, but
+	// clients may append EDNS options.
+	maxDNSMessage = 1500
+)
+
+// DNS constants from RFC 1035 and RFC 3596.
+const (
+	dnsTypeA   = 1
+	dnsClassIN = 1
+
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+)
+
+// ServeDNS answers DNS queries for names under DNSDomain on conn until conn is
+// closed, looking services up like FindServicesMatching with case-insensitive
+// names. A queries return the addresses of all matching TCP services. As
+// services are IPv4-only, AAAA queries get an empty answer. A records can't
+// carry ports, so clients need to know them.
+//
+// Queries for other domains are refused, so ServeDNS is meant to be set up as
+// the resolver for DNSDomain only, e.g. with systemd-resolved or dnsmasq.
+//
+// Answers come from a snapshot of ListServices that's refreshed every few
+// seconds (see Cache), so that queries, which anyone who can reach conn can
+// send, don't each query the whole Tailnet.
+func ServeDNS(conn net.PacketConn) error {
+	return ServeDNSWithOptions(conn, QueryOptions{})
+}
+
+// ServeDNSWithOptions is like ServeDNS, but allows customizing the queries for
+// the snapshot, e.g. to use another registry port.
+func ServeDNSWithOptions(conn net.PacketConn, opts QueryOptions) error {
+	cache := NewCacheWithOptions(dnsRefresh, opts)
+	defer cache.Close()
+	lookup := func(name string) ([]netip.Addr, error) {
+		return lookupDNS(cache, name)
+	}
+	sem := make(chan struct{}, maxDNSQueries)
+	buf := make([]byte, maxDNSMessage)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		query := slices.Clone(buf[:n])
+		select {
+		case sem <- struct{}{}:
+		default:
+			logger.Debugf("Dropping DNS query from %v, too many in flight", addr)
+			continue
+		}
+		go func() {
+			defer func() { <-sem }()
+			if resp := answerDNS(query, lookup); resp != nil {
+				if _, err := conn.WriteTo(resp, addr); err != nil {
+					logger.Debugf("Error answering DNS query from %v: %v", addr, err)
+				}
+			}
+		}()
+	}
+}
+
+// lookupDNS returns the addresses of the TCP services in cache named name,
+// ignoring case.
+func lookupDNS(cache *Cache, name string) ([]netip.Addr, error) {
+	match := MatchOptions{CaseInsensitive: true}
+	var addrs []netip.Addr
+	for _, s := range cache.Services() {
+		if match.Matches(s, name, nil) && s.AddrPort.IsValid() &&
+			!slices.Contains(addrs, s.AddrPort.Addr()) {
+			addrs = append(addrs, s.AddrPort.Addr())
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if err := cache.Err(); err != nil && cache.LastRefresh().IsZero() {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w for %s", ErrServiceNotFound, name)
+}
+
+// answerDNS returns the response to query, using lookup to find the addresses
+// of services. It returns nil for messages that don't deserve an answer.
+func answerDNS(query []byte, lookup func(name string) ([]netip.Addr, error)) []byte {
+	if len(query) < 12 {
+		return nil // Not even a header.
+	}
+	flags := binary.BigEndian.Uint16(query[2:4])
+	if flags&0x8000 != 0 {
+		return nil // A response, not a query.
+	}
+	// Echo the ID, opcode and recursion desired flag, and set QR and AA.
+	reply := func(rcode uint16, question []byte, answers []netip.Addr) []byte {
+		resp := slices.Clone(query[:2])
+		resp = binary.BigEndian.AppendUint16(resp, 0x8400|flags&0x7900|rcode)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(min(len(question), 1)))
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(answers)))
+		resp = append(resp, 0, 0, 0, 0) // No authority or additional records.
+		resp = append(resp, question...)
+		for _, addr := range answers {
+			resp = append(resp, 0xc0, 12) // Pointer to the name in the question.
+			resp = binary.BigEndian.AppendUint16(resp, dnsTypeA)
+			resp = binary.BigEndian.AppendUint16(resp, dnsClassIN)
+			resp = binary.BigEndian.AppendUint32(resp, dnsTTL)
+			resp = binary.BigEndian.AppendUint16(resp, 4)
+			resp = append(resp, addr.AsSlice()...)
+		}
+		return resp
+	}
+	if opcode := flags >> 11 & 0xf; opcode != 0 {
+		return reply(dnsRcodeNotImp, nil, nil)
+	}
+	if binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return reply(dnsRcodeFormErr, nil, nil)
+	}
+	name, end, ok := parseDNSName(query, 12)
+	if !ok || end+4 > len(query) {
+		return reply(dnsRcodeFormErr, nil, nil)
+	}
+	question := query[12 : end+4]
+	qtype := binary.BigEndian.Uint16(query[end : end+2])
+	qclass := binary.BigEndian.Uint16(query[end+2 : end+4])
+
+	service, ok := strings.CutSuffix(strings.ToLower(name), "."+DNSDomain)
+	if !ok || service == "" {
+		return reply(dnsRcodeRefused, question, nil)
+	}
+	addrs, err := lookup(service)
+	if errors.Is(err, ErrServiceNotFound) {
+		return reply(dnsRcodeNXDomain, question, nil)
+	} else if err != nil {
+		logger.Warnf("Error resolving %s for DNS query: %v", name, err)
+		return reply(dnsRcodeServFail, question, nil)
+	}
+	if qtype != dnsTypeA || qclass != dnsClassIN {
+		// The name exists, but has no records of this type.
+		return reply(0, question, nil)
+	}
+	return reply(0, question, addrs)
+}
+
+// parseDNSName reads the domain name starting at msg[off], and returns it
+// without trailing dot, and the offset after it. Compressed names aren't
+// supported, as they don't occur in the question of a query.
+func parseDNSName(msg []byte, off int) (string, int, bool) {
+	var labels []string
+	length := 0
+	for {
+		if off >= len(msg) {
+			return "", 0, false
+		}
+		l := int(msg[off])
+		off++
+		if l == 0 {
+			break
+		}
+		length += l + 1
+		if l&0xc0 != 0 || off+l > len(msg) || length > 255 {
+			return "", 0, false
+		}
+		labels = append(labels, string(msg[off:off+l]))
+		off += l
+	}
+	return strings.Join(labels, "."), off, true
+}
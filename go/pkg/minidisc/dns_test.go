@@ -0,0 +1,163 @@
+package minidisc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// dnsQuery builds a query for name with the given type.
+func dnsQuery(name string, qtype uint16) []byte {
+	q := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0)
+	q = binary.BigEndian.AppendUint16(q, qtype)
+	return binary.BigEndian.AppendUint16(q, dnsClassIN)
+}
+
+func TestAnswerDNS(t *testing.T) {
+	lookup := func(name string) ([]netip.Addr, error) {
+		switch name {
+		case "web":
+			return []netip.Addr{
+				netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("100.64.0.2"),
+			}, nil
+		case "broken":
+			return nil, ErrTailnetUnavailable
+		}
+		return nil, fmt.Errorf("%w for %s", ErrServiceNotFound, name)
+	}
+	cases := []struct {
+		title   string
+		query   []byte
+		rcode   uint16
+		answers int
+	}{
+		{"found", dnsQuery("web.minidisc", 1), 0, 2},
+		{"case insensitive", dnsQuery("WEB.Minidisc", 1), 0, 2},
+		{"ipv6", dnsQuery("web.minidisc", 28), 0, 0},
+		{"not found", dnsQuery("db.minidisc", 1), dnsRcodeNXDomain, 0},
+		{"lookup error", dnsQuery("broken.minidisc", 1), dnsRcodeServFail, 0},
+		{"other domain", dnsQuery("example.com", 1), dnsRcodeRefused, 0},
+		{"bare domain", dnsQuery("minidisc", 1), dnsRcodeRefused, 0},
+		{"truncated", dnsQuery("web.minidisc", 1)[:20], dnsRcodeFormErr, 0},
+		{"compressed", append(dnsQuery("", 1)[:12], 0xc0, 12, 0, 1, 0, 1), dnsRcodeFormErr, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			resp := answerDNS(c.query, lookup)
+			if len(resp) < 12 {
+				t.Fatalf("Short response %v", resp)
+			}
+			if resp[0] != 0x12 || resp[1] != 0x34 {
+				t.Errorf("Response ID %x doesn't match query", resp[:2])
+			}
+			flags := binary.BigEndian.Uint16(resp[2:4])
+			if flags&0x8000 == 0 || flags&0x0100 == 0 {
+				t.Errorf("Expected QR and RD flags, got %04x", flags)
+			}
+			if rcode := flags & 0xf; rcode != c.rcode {
+				t.Errorf("Expected rcode %d, got %d", c.rcode, rcode)
+			}
+			if n := binary.BigEndian.Uint16(resp[6:8]); int(n) != c.answers {
+				t.Errorf("Expected %d answers, got %d", c.answers, n)
+			}
+		})
+	}
+	if resp := answerDNS([]byte{1, 2, 3}, lookup); resp != nil {
+		t.Errorf("Expected no answer to garbage, got %v", resp)
+	}
+	query := dnsQuery("web.minidisc", 1)
+	query[2] |= 0x80
+	if resp := answerDNS(query, lookup); resp != nil {
+		t.Errorf("Expected no answer to a response, got %v", resp)
+	}
+}
+
+func TestServeDNS(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- ServeDNS(conn) }()
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+	addrs, err := resolver.LookupNetIP(context.Background(), "ip4", "foo.minidisc.")
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if want := []netip.Addr{netip.MustParseAddr("127.0.0.2")}; !slices.Equal(addrs, want) {
+		t.Errorf("Expected %v, got %v", want, addrs)
+	}
+	_, err = resolver.LookupNetIP(context.Background(), "ip4", "missing.minidisc.")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ServeDNS failed after close: %v", err)
+	}
+}
+
+func TestRegistryDNS(t *testing.T) {
+	oldAddr := fakeTailnetMap.LocalAddr
+	fakeTailnetMap.LocalAddr = netip.MustParseAddr("127.0.0.20")
+	defer func() { fakeTailnetMap.LocalAddr = oldAddr }()
+	r, err := StartRegistryWithOptions(StartRegistryOptions{DNSAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := dnsQuery("bar.minidisc", dnsTypeA)
+	client, err := net.Dial("udp", r.dnsConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write(query)
+	resp := make([]byte, maxDNSMessage)
+	if n, err := client.Read(resp); err != nil || n < 12 || resp[3]&0xf != 0 {
+		t.Errorf("Bad DNS response %v: %v", resp[:n], err)
+	}
+	r.Close()
+	if _, err := r.dnsConn.WriteTo(query, client.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected DNS socket to be closed, got %v", err)
+	}
+}
+
+func TestRegistryDNSPort(t *testing.T) {
+	oldAddr := fakeTailnetMap.LocalAddr
+	fakeTailnetMap.LocalAddr = netip.MustParseAddr("127.0.0.26")
+	defer func() { fakeTailnetMap.LocalAddr = oldAddr }()
+	r, err := StartRegistryWithOptions(StartRegistryOptions{Port: 28014, DNSAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	client, err := net.Dial("udp", r.dnsConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// bar is only advertised on the default port, which this mesh doesn't see.
+	client.Write(dnsQuery("bar.minidisc", dnsTypeA))
+	resp := make([]byte, maxDNSMessage)
+	if n, err := client.Read(resp); err != nil || n < 12 || resp[3]&0xf != dnsRcodeNXDomain {
+		t.Errorf("Expected NXDOMAIN, got %v: %v", resp[:n], err)
+	}
+}
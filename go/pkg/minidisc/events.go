@@ -0,0 +1,288 @@
+// Server-Sent Events about changes to a registry's services.
+package minidisc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types sent on /events. Service events carry the service as JSON,
+// delegate events its address as {"addrPort": ...}.
+const (
+	EventServiceAdded    = "added"
+	EventServiceRemoved  = "removed"
+	EventServiceUpdated  = "updated"
+	EventDelegateAdded   = "delegate-added"
+	EventDelegateRemoved = "delegate-removed"
+	// EventReset means that events were missed, e.g. because the registry
+	// restarted, so the client needs to list the services again.
+	EventReset = "reset"
+)
+
+const (
+	// maxEventBacklog is how many past events a registry keeps for clients
+	// that reconnect with Last-Event-ID.
+	maxEventBacklog = 256
+	// eventBuffer is how many events may queue up for a slow client before
+	// it's disconnected. It can resume from where it was.
+	eventBuffer = 64
+	// eventKeepAlive is how often an idle stream gets a comment, so proxies
+	// and clients don't time it out.
+	eventKeepAlive = 30 * time.Second
+	// minForwardBackoff and maxForwardBackoff bound how long a leader waits
+	// before it subscribes to a delegate's events again.
+	minForwardBackoff = time.Second
+	maxForwardBackoff = 30 * time.Second
+)
+
+type event struct {
+	id   string
+	kind string
+	data []byte
+}
+
+// eventLog keeps recent events and fans new ones out to subscribers. The zero
+// value is ready to use.
+type eventLog struct {
+	mutex sync.Mutex
+	// Distinguishes event IDs across registry restarts.
+	epoch  int64
+	seq    uint64
+	events []event // Up to maxEventBacklog, oldest first.
+	subs   map[chan event]struct{}
+}
+
+// publish sends an event with v as JSON data to all subscribers.
+func (l *eventLog) publish(kind string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Fatalf("Error marshalling JSON: %v", err)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.init()
+	l.seq++
+	ev := event{id: fmt.Sprintf("%d-%d", l.epoch, l.seq), kind: kind, data: data}
+	l.events = append(l.events, ev)
+	if len(l.events) > maxEventBacklog {
+		l.events = l.events[1:]
+	}
+	for ch := range l.subs {
+		select {
+		case ch <- ev:
+		default:
+			// Too slow; it needs to reconnect.
+			close(ch)
+			delete(l.subs, ch)
+		}
+	}
+}
+
+func (l *eventLog) init() {
+	if l.epoch == 0 {
+		l.epoch = time.Now().UnixNano()
+		l.subs = make(map[chan event]struct{})
+	}
+}
+
+// subscribe returns the events after lastID, and a channel for new ones, which
+// is closed if the subscriber falls behind. If lastID is set but can't be
+// resumed from, the backlog is a single EventReset. The cancel function must
+// be called when done.
+func (l *eventLog) subscribe(lastID string) ([]event, <-chan event, func()) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.init()
+	var backlog []event
+	if lastID != "" {
+		backlog = l.since(lastID)
+	}
+	ch := make(chan event, eventBuffer)
+	l.subs[ch] = struct{}{}
+	cancel := func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		delete(l.subs, ch)
+	}
+	return backlog, ch, cancel
+}
+
+// since returns the events after the one with ID lastID.
+func (l *eventLog) since(lastID string) []event {
+	reset := []event{{id: fmt.Sprintf("%d-%d", l.epoch, l.seq), kind: EventReset, data: []byte("{}")}}
+	epoch, seqStr, _ := strings.Cut(lastID, "-")
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil || epoch != strconv.FormatInt(l.epoch, 10) || seq > l.seq {
+		return reset
+	}
+	// Events have consecutive sequence numbers, ending at l.seq.
+	missed := l.seq - seq
+	if missed > uint64(len(l.events)) {
+		return reset
+	}
+	return append([]event(nil), l.events[uint64(len(l.events))-missed:]...)
+}
+
+// shutdownKey is the context key for a channel that's closed when the server
+// shuts down. Streams need to end then, as shutdown waits for them.
+type shutdownKey struct{}
+
+// handleGetEvents handles "GET /events", which streams changes to the services
+// of this registry as Server-Sent Events. A leader forwards the service events
+// of its delegates, too, and sends events when delegates come and go, which is
+// when clients should list the services again. Clients resume with
+// Last-Event-ID after reconnecting.
+func (r *Registry) handleGetEvents(wrt http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		wrt.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rc := http.NewResponseController(wrt)
+	// Streams outlive the server's write timeout.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+		logger.Warnf("Cannot clear write deadline for event stream: %v", err)
+	}
+	backlog, events, cancel := r.events.subscribe(req.Header.Get("Last-Event-ID"))
+	defer cancel()
+	shutdown, _ := req.Context().Value(shutdownKey{}).(chan struct{})
+
+	wrt.Header().Set("Content-Type", "text/event-stream")
+	wrt.Header().Set("Cache-Control", "no-cache")
+	wrt.Header().Set(versionHeader, strconv.Itoa(ProtocolVersion))
+	wrt.WriteHeader(http.StatusOK)
+	for _, ev := range backlog {
+		writeEvent(wrt, ev)
+	}
+	rc.Flush()
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			writeEvent(wrt, ev)
+		case <-keepAlive.C:
+			fmt.Fprint(wrt, ": keep-alive\n\n")
+		case <-req.Context().Done():
+			return
+		case <-shutdown:
+			return
+		case <-r.stop:
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(wrt http.ResponseWriter, ev event) {
+	fmt.Fprintf(wrt, "id: %s\nevent: %s\ndata: %s\n\n", ev.id, ev.kind, ev.data)
+}
+
+// forwardEvents subscribes to the events of the delegate at d and publishes its
+// service events as our own, until ctx is done. EventDelegateAdded is only
+// published once the subscription is up, or failed, so that clients listing
+// the services in response don't miss changes in between.
+func (r *Registry) forwardEvents(ctx context.Context, d netip.AddrPort) {
+	announced := false
+	announce := func() {
+		if announced {
+			return
+		}
+		announced = true
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if ctx.Err() == nil {
+			r.events.publish(EventDelegateAdded, addDelegateRequest{AddrPort: d})
+		}
+	}
+	lastID := ""
+	backoff := minForwardBackoff
+	for {
+		err := r.relayEvents(ctx, d, &lastID, announce)
+		announce()
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Debugf("Event stream of delegate %s ended: %v", d, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxForwardBackoff)
+	}
+}
+
+// relayEvents reads the event stream of the delegate at d, starting after
+// *lastID, and publishes its service events until the stream ends. It calls
+// subscribed once the stream is up.
+func (r *Registry) relayEvents(
+	ctx context.Context, d netip.AddrPort, lastID *string, subscribed func(),
+) error {
+	url := fmt.Sprintf("http://%s/events", d)
+	req, err := newRequest(ctx, "GET", url, r.authToken, nil)
+	if err != nil {
+		return err
+	}
+	if *lastID != "" {
+		req.Header.Set("Last-Event-ID", *lastID)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s while subscribing to events", resp.Status)
+	}
+	subscribed()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, int(currentMaxResponseSize()))
+	var id, kind, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, ":") {
+			continue // A comment, e.g. a keep-alive.
+		} else if line != "" {
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				id = value
+			case "event":
+				kind = value
+			case "data":
+				data = value
+			}
+			continue
+		}
+		// End of the event. A reset from the delegate means we missed some,
+		// so our clients need to list the services again, too.
+		switch kind {
+		case EventServiceAdded, EventServiceRemoved, EventServiceUpdated, EventReset:
+			if json.Valid([]byte(data)) {
+				r.events.publish(kind, json.RawMessage(data))
+			}
+		}
+		if kind != "" {
+			*lastID = id
+		}
+		kind, data = "", ""
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("Stream closed")
+}
@@ -0,0 +1,181 @@
+package minidisc
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventLog(t *testing.T) {
+	var l eventLog
+	for range 3 {
+		l.publish(EventServiceAdded, Service{Name: "svc"})
+	}
+	first := l.events[0].id
+	backlog, _, cancel := l.subscribe(first)
+	cancel()
+	if len(backlog) != 2 || backlog[0].id != l.events[1].id {
+		t.Errorf("Expected the last 2 events after %s, got %v", first, backlog)
+	}
+	if backlog, _, cancel := l.subscribe(""); len(backlog) != 0 {
+		t.Errorf("Expected no backlog for new subscriber, got %v", backlog)
+		cancel()
+	}
+	for _, id := range []string{"1-1", "garbage", first[:len(first)-1] + "9"} {
+		backlog, _, cancel := l.subscribe(id)
+		cancel()
+		if len(backlog) != 1 || backlog[0].kind != EventReset {
+			t.Errorf("Expected reset for ID %q, got %v", id, backlog)
+		}
+	}
+
+	// Subscribers that fall behind are dropped.
+	_, ch, cancel := l.subscribe("")
+	defer cancel()
+	for range eventBuffer + 1 {
+		l.publish(EventServiceRemoved, Service{Name: "svc"})
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != eventBuffer {
+		t.Errorf("Expected %d events before drop, got %d", eventBuffer, n)
+	}
+	// By now, the first event is too old to resume from.
+	for range maxEventBacklog {
+		l.publish(EventServiceAdded, Service{Name: "svc"})
+	}
+	if backlog, _, cancel := l.subscribe(first); len(backlog) != 1 || backlog[0].kind != EventReset {
+		t.Errorf("Expected reset for expired ID, got %v", backlog)
+		cancel()
+	}
+}
+
+// readEvent reads the next event from an SSE stream, skipping comments.
+func readEvent(t *testing.T, rd *bufio.Reader) (id, kind, data string) {
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && kind != "" {
+			return id, kind, data
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			id = value
+		case "event":
+			kind = value
+		case "data":
+			data = value
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	r := newTestRegistry()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected event stream, got %q", ct)
+	}
+	rd := bufio.NewReader(resp.Body)
+
+	r.AdvertiseService(4242, "evented", nil)
+	firstID, kind, data := readEvent(t, rd)
+	if kind != EventServiceAdded || !strings.Contains(data, `"name":"evented"`) {
+		t.Errorf("Expected added event, got %s %s", kind, data)
+	}
+	r.UpdateServiceLabels("evented", map[string]string{"env": "prod"})
+	if _, kind, data := readEvent(t, rd); kind != EventServiceUpdated || !strings.Contains(data, `"env":"prod"`) {
+		t.Errorf("Expected updated event, got %s %s", kind, data)
+	}
+	r.UnlistService(4242)
+	if _, kind, _ := readEvent(t, rd); kind != EventServiceRemoved {
+		t.Errorf("Expected removed event, got %s", kind)
+	}
+	r.tryAddDelegate(netip.MustParseAddrPort("127.0.0.2:40000"))
+	if _, kind, data := readEvent(t, rd); kind != EventDelegateAdded || !strings.Contains(data, "127.0.0.2:40000") {
+		t.Errorf("Expected delegate-added event, got %s %s", kind, data)
+	}
+
+	// Resuming replays what was missed.
+	req, _ := http.NewRequest("GET", srv.URL+"/events", nil)
+	req.Header.Set("Last-Event-ID", firstID)
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	rd2 := bufio.NewReader(resp2.Body)
+	for _, want := range []string{EventServiceUpdated, EventServiceRemoved, EventDelegateAdded} {
+		if _, kind, _ := readEvent(t, rd2); kind != want {
+			t.Errorf("Expected replayed %s event, got %s", want, kind)
+		}
+	}
+}
+
+func TestEventsEndOnShutdown(t *testing.T) {
+	r := newTestRegistry()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := r.newServer()
+	go srv.Serve(ln)
+	resp, err := http.Get("http://" + ln.Addr().String() + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown blocked by event stream: %v", err)
+	}
+}
+
+func TestForwardDelegateEvents(t *testing.T) {
+	delegate := newTestRegistry()
+	delegateSrv := httptest.NewServer(delegate)
+	defer delegateSrv.Close()
+	leader := newTestRegistry()
+	leaderSrv := httptest.NewServer(leader)
+	defer leaderSrv.Close()
+	resp, err := http.Get(leaderSrv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	rd := bufio.NewReader(resp.Body)
+
+	d := netip.MustParseAddrPort(delegateSrv.Listener.Addr().String())
+	leader.tryAddDelegate(d)
+	defer leader.removeDelegate(d)
+	if _, kind, _ := readEvent(t, rd); kind != EventDelegateAdded {
+		t.Fatalf("Expected delegate-added event, got %s", kind)
+	}
+	// Once clients learned about the delegate, its changes are forwarded.
+	delegate.AdvertiseService(4343, "delegated", nil)
+	if _, kind, data := readEvent(t, rd); kind != EventServiceAdded || !strings.Contains(data, `"name":"delegated"`) {
+		t.Errorf("Expected forwarded added event, got %s %s", kind, data)
+	}
+	delegate.UnlistService(4343)
+	if _, kind, _ := readEvent(t, rd); kind != EventServiceRemoved {
+		t.Errorf("Expected forwarded removed event, got %s", kind)
+	}
+}
@@ -26,6 +26,12 @@ func SetLogger(l Logger) {
 	logger = l
 }
 
+// GetLogger returns the logger set with SetLogger, so that packages building on
+// this one can log through it, too.
+func GetLogger() Logger {
+	return logger
+}
+
 type LevelLogger struct {
 	Level int
 }
@@ -0,0 +1,167 @@
+// Service matching for FindService and its variants.
+package minidisc
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// AnyLabelValue as the value of a requested label matches services that have
+// the label, regardless of its value.
+const AnyLabelValue = "*"
+
+// MatchOptions relaxes how service names are compared. The zero value requires
+// an exact match. Labels are always compared exactly.
+type MatchOptions struct {
+	// CaseInsensitive ignores case differences in the name.
+	CaseInsensitive bool
+	// Prefix matches all services whose name starts with the given name.
+	Prefix bool
+}
+
+// FindServicesMatching returns all services that match the name, according to
+// opts, and the given labels. Labels match like in FindService. If nothing
+// matches, the error wraps ErrServiceNotFound.
+func FindServicesMatching(
+	name string, labels map[string]string, opts MatchOptions,
+) ([]Service, error) {
+	ss, err := ListServices()
+	if err != nil {
+		return nil, err
+	}
+	var result []Service
+	for _, s := range ss {
+		if opts.Matches(s, name, labels) {
+			result = append(result, s)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrServiceNotFound, name)
+	}
+	return result, nil
+}
+
+// FindServicesPrefix returns all services whose name starts with prefix and
+// that match the given labels.
+func FindServicesPrefix(prefix string, labels map[string]string) ([]Service, error) {
+	return FindServicesMatching(prefix, labels, MatchOptions{Prefix: true})
+}
+
+// PatternSyntax selects how FindServicesPattern interprets its pattern.
+type PatternSyntax int
+
+const (
+	// Glob patterns support "*" for any sequence of characters and "?" for a
+	// single character. Everything else matches literally.
+	Glob PatternSyntax = iota
+	// Regexp patterns use Go's regexp syntax, and must match the whole name.
+	Regexp
+)
+
+// FindServicesPattern returns all services whose name matches pattern and that
+// have the given labels. Invalid patterns return an error. If nothing matches,
+// the error wraps ErrServiceNotFound.
+func FindServicesPattern(
+	pattern string, labels map[string]string, syntax PatternSyntax,
+) ([]Service, error) {
+	return FindServicesPatternWithOptions(pattern, labels, syntax, QueryOptions{})
+}
+
+// FindServicesPatternWithOptions is like FindServicesPattern, but allows
+// customizing the query.
+func FindServicesPatternWithOptions(
+	pattern string, labels map[string]string, syntax PatternSyntax, opts QueryOptions,
+) ([]Service, error) {
+	re, err := compilePattern(pattern, syntax)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := ListServicesWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	var result []Service
+	for _, s := range ss {
+		if slices.ContainsFunc(s.names(), re.MatchString) && labelsMatch(s.Labels, labels) {
+			result = append(result, s)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrServiceNotFound, pattern)
+	}
+	return result, nil
+}
+
+// compilePattern turns a glob or regexp into a regexp matching whole names.
+func compilePattern(pattern string, syntax PatternSyntax) (*regexp.Regexp, error) {
+	expr := pattern
+	switch syntax {
+	case Glob:
+		expr = regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+	case Regexp:
+	default:
+		return nil, fmt.Errorf("Unknown pattern syntax %d", syntax)
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pattern %q: %v", pattern, err)
+	}
+	return re, nil
+}
+
+// firstMatch returns the address of the first TCP service in ss that matches
+// name and labels, as FindService does.
+func firstMatch(ss []Service, name string, labels map[string]string) (netip.AddrPort, bool) {
+	for _, s := range ss {
+		if s.AddrPort.IsValid() && serviceMatches(s, name, labels) {
+			return s.AddrPort, true
+		}
+	}
+	return netip.AddrPort{}, false
+}
+
+// serviceMatches implements the matching logic for FindService.
+func serviceMatches(s Service, name string, labels map[string]string) bool {
+	return MatchOptions{}.Matches(s, name, labels)
+}
+
+// Matches returns whether s's name or one of its aliases matches name according
+// to o, and s has all labels. It's useful to filter services from ListServices.
+func (o MatchOptions) Matches(s Service, name string, labels map[string]string) bool {
+	return slices.ContainsFunc(s.names(), func(n string) bool {
+		return o.nameMatches(n, name)
+	}) && labelsMatch(s.Labels, labels)
+}
+
+// nameMatches returns whether sName matches name according to o.
+func (o MatchOptions) nameMatches(sName, name string) bool {
+	if o.CaseInsensitive {
+		sName, name = strings.ToLower(sName), strings.ToLower(name)
+	}
+	if o.Prefix {
+		return strings.HasPrefix(sName, name)
+	}
+	return sName == name
+}
+
+// names returns the name and aliases of s.
+func (s Service) names() []string {
+	return append([]string{s.Name}, s.Aliases...)
+}
+
+// labelsMatch returns whether have contains all key-value pairs in want. Keys
+// wanted with AnyLabelValue only need to exist.
+func labelsMatch(have, want map[string]string) bool {
+	for k, v := range want {
+		sv, ok := have[k]
+		if !ok || (v != AnyLabelValue && v != sv) {
+			return false
+		}
+	}
+	return true
+}
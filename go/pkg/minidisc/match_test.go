@@ -0,0 +1,88 @@
+package minidisc
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMatchOptions(t *testing.T) {
+	s := Service{
+		Name:    "api-prod-us",
+		Aliases: []string{"gateway-us"},
+		Labels:  map[string]string{"env": "prod"},
+	}
+	cases := []struct {
+		title string
+		opts  MatchOptions
+		name  string
+		lbls  map[string]string
+		want  bool
+	}{
+		{"exact", MatchOptions{}, "api-prod-us", nil, true},
+		{"exact rejects prefix", MatchOptions{}, "api-prod", nil, false},
+		{"exact rejects case", MatchOptions{}, "API-prod-us", nil, false},
+		{"prefix", MatchOptions{Prefix: true}, "api-prod", nil, true},
+		{"prefix mismatch", MatchOptions{Prefix: true}, "api-staging", nil, false},
+		{"case-insensitive", MatchOptions{CaseInsensitive: true}, "API-Prod-US", nil, true},
+		{"case-insensitive prefix", MatchOptions{CaseInsensitive: true, Prefix: true}, "API", nil, true},
+		{"prefix with labels", MatchOptions{Prefix: true}, "api", map[string]string{"env": "prod"}, true},
+		{"prefix with wrong labels", MatchOptions{Prefix: true}, "api", map[string]string{"env": "dev"}, false},
+		{"alias", MatchOptions{}, "gateway-us", nil, true},
+		{"alias prefix", MatchOptions{Prefix: true}, "gateway", nil, true},
+		{"alias case-insensitive", MatchOptions{CaseInsensitive: true}, "Gateway-US", nil, true},
+		{"alias with wrong labels", MatchOptions{}, "gateway-us", map[string]string{"env": "dev"}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			if got := c.opts.Matches(s, c.name, c.lbls); got != c.want {
+				t.Errorf("Matches() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestFindServicesPrefix(t *testing.T) {
+	// "bar" and "baz" are advertised by the fake peers.
+	ss, err := FindServicesPrefix("ba", nil)
+	if err != nil {
+		t.Fatalf("FindServicesPrefix failed: %v", err)
+	}
+	if len(ss) != 2 {
+		t.Errorf("Expected 2 services, got %v", ss)
+	}
+	_, err = FindServicesPrefix("nope", nil)
+	if !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("Expected ErrServiceNotFound, got %v", err)
+	}
+}
+
+func TestCompilePattern(t *testing.T) {
+	cases := []struct {
+		title   string
+		pattern string
+		syntax  PatternSyntax
+		name    string
+		want    bool
+	}{
+		{"glob star", "*.prod", Glob, "api.prod", true},
+		{"glob is anchored", "*.prod", Glob, "api.prod.eu", false},
+		{"glob question mark", "api-?", Glob, "api-1", true},
+		{"glob dot is literal", "api.*", Glob, "apix", false},
+		{"regexp", `api-(us|eu)`, Regexp, "api-eu", true},
+		{"regexp is anchored", `api`, Regexp, "api-eu", false},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			re, err := compilePattern(c.pattern, c.syntax)
+			if err != nil {
+				t.Fatalf("compilePattern failed: %v", err)
+			}
+			if got := re.MatchString(c.name); got != c.want {
+				t.Errorf("Match(%q) = %v, want %v", c.name, got, c.want)
+			}
+		})
+	}
+	if _, err := FindServicesPattern("api-(", nil, Regexp); err == nil {
+		t.Errorf("Expected error for invalid regexp")
+	}
+}
@@ -4,205 +4,1799 @@ package minidisc
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/netip"
 	"net/url"
+	"os"
+	"path/filepath"
 	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 // Service represents a network service on the Tailnet.
+//
+// In JSON, as registries exchange it, "name", "labels", "annotations",
+// "addrPort", "registeredAt" and "source" are always present, with labels and
+// annotations as objects, never null. "aliases", "target", "scheme" and
+// "grpcConfig" are omitted when empty. Readers must ignore unknown fields, so
+// new ones can be added.
 type Service struct {
-	Name     string            `json:"name"`
-	Labels   map[string]string `json:"labels"`
-	AddrPort netip.AddrPort    `json:"addrPort"`
+	Name string `json:"name"`
+	// Aliases are further names the service can be found by. Registries that
+	// predate them drop them, so such services only match their Name.
+	Aliases []string          `json:"aliases,omitempty"`
+	Labels  map[string]string `json:"labels"`
+	// AddrPort is the address of a TCP service. It's the zero value for
+	// services that aren't reachable over TCP, see Target.
+	AddrPort netip.AddrPort `json:"addrPort"`
+	// Target is where the service can be reached, as a URL with scheme "tcp"
+	// or "unix", e.g. "tcp://100.1.2.3:80" or "unix:///run/app.sock". For TCP
+	// services, it's derived from AddrPort.
+	Target string `json:"target,omitempty"`
+	// Scheme is the protocol the service speaks, e.g. "http", "https", "grpc"
+	// or "tcp". Empty means unspecified.
+	Scheme string `json:"scheme,omitempty"`
+	// GRPCConfig is a gRPC service config in JSON, e.g. to select the load
+	// balancing policy. The gRPC resolver in package mdgrpc passes it on to
+	// clients.
+	GRPCConfig string `json:"grpcConfig,omitempty"`
+	// Annotations are free-form metadata, e.g. a description or version. Unlike
+	// labels, they're ignored when matching services.
+	Annotations map[string]string `json:"annotations"`
+	// RegisteredAt is when the service was advertised. It's the zero value
+	// for services listed by registries that predate this field.
+	RegisteredAt time.Time `json:"registeredAt"`
+	// Source is the address of the registry that advertises the service. This
+	// includes the port, since a leader and its delegates share the host's
+	// address. It's set when the service is listed, not when advertised.
+	Source netip.AddrPort `json:"source"`
+}
+
+// ServiceOption sets optional properties of an advertised service.
+type ServiceOption func(*Service)
+
+// WithAnnotations attaches annotations to an advertised service.
+func WithAnnotations(annotations map[string]string) ServiceOption {
+	return func(s *Service) {
+		s.Annotations = annotations
+	}
+}
+
+// WithScheme sets the protocol an advertised service speaks, see
+// Service.Scheme.
+func WithScheme(scheme string) ServiceOption {
+	return func(s *Service) {
+		s.Scheme = scheme
+	}
+}
+
+// WithAliases makes an advertised service findable by further names, see
+// Service.Aliases.
+func WithAliases(aliases ...string) ServiceOption {
+	return func(s *Service) {
+		s.Aliases = aliases
+	}
+}
+
+// WithGRPCConfig attaches a gRPC service config in JSON to an advertised
+// service, see Service.GRPCConfig.
+func WithGRPCConfig(config string) ServiceOption {
+	return func(s *Service) {
+		s.GRPCConfig = config
+	}
+}
+
+// Service targets use these URL schemes.
+const (
+	tcpScheme  = "tcp://"
+	unixScheme = "unix://"
+)
+
+// tcpTarget returns the target of a TCP service at ap.
+func tcpTarget(ap netip.AddrPort) string {
+	return tcpScheme + ap.String()
+}
+
+// UnixSocketPath returns the socket path of a service advertised with
+// AdvertiseUnixService, and whether it is one.
+func (s Service) UnixSocketPath() (string, bool) {
+	return strings.CutPrefix(s.Target, unixScheme)
+}
+
+// validateService checks that s has a name and a usable address: either a TCP
+// address with a port, or a Unix socket.
+func validateService(s Service) error {
+	if s.Name == "" {
+		return errors.New("Missing name")
+	}
+	if s.AddrPort.IsValid() {
+		if s.AddrPort.Port() == 0 {
+			return fmt.Errorf("Port 0 in address %s", s.AddrPort)
+		}
+		return nil
+	}
+	if path, ok := s.UnixSocketPath(); ok && filepath.IsAbs(path) {
+		return nil
+	}
+	return fmt.Errorf("No valid address, target %q", s.Target)
+}
+
+// Equal reports whether s and other describe the same service. Unlike
+// comparing with ==, which doesn't work for maps anyway, it treats nil and
+// empty label and annotation maps as equal, and times as equal if they denote
+// the same instant.
+func (s Service) Equal(other Service) bool {
+	return s.Name == other.Name &&
+		slices.Equal(s.Aliases, other.Aliases) &&
+		maps.Equal(s.Labels, other.Labels) &&
+		s.AddrPort == other.AddrPort &&
+		s.Target == other.Target &&
+		s.Scheme == other.Scheme &&
+		s.GRPCConfig == other.GRPCConfig &&
+		maps.Equal(s.Annotations, other.Annotations) &&
+		s.RegisteredAt.Equal(other.RegisteredAt) &&
+		s.Source == other.Source
+}
+
+// MarshalJSON encodes a service with the fields documented for Service, writing
+// nil labels and annotations as empty objects.
+func (s Service) MarshalJSON() ([]byte, error) {
+	type plain Service // Without methods, so this doesn't recurse.
+	p := plain(s)
+	if p.Labels == nil {
+		p.Labels = map[string]string{}
+	}
+	if p.Annotations == nil {
+		p.Annotations = map[string]string{}
+	}
+	return json.Marshal(p)
+}
+
+// UnmarshalJSON decodes a service and normalizes it, so that services from
+// registries that omit labels or send them as null still have a Labels map.
+// Empty annotations decode as nil, as they did while registries omitted them.
+func (s *Service) UnmarshalJSON(data []byte) error {
+	type plain Service // Without methods, so this doesn't recurse.
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	if len(p.Annotations) == 0 {
+		p.Annotations = nil
+	}
+	*s = NormalizeService(Service(p))
+	return nil
+}
+
+// NormalizeService returns s with a non-nil Labels map, and for TCP services,
+// the Target derived from AddrPort if it's missing. All services this package
+// returns are normalized.
+func NormalizeService(s Service) Service {
+	if s.Labels == nil {
+		s.Labels = make(map[string]string)
+	}
+	if s.Target == "" && s.AddrPort.IsValid() {
+		s.Target = tcpTarget(s.AddrPort)
+	}
+	return s
+}
+
+// Network access //////////////////////////////////////////////////////////////
+
+// Dialer opens network connections for Minidisc's HTTP traffic. It has the same
+// signature as net.Dialer.DialContext.
+type Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// settingsMutex guards the process-wide client settings below, which the
+// setters may change while queries are running.
+var settingsMutex sync.Mutex
+
+var dialer Dialer = (&net.Dialer{}).DialContext
+
+// SetDialer replaces the dialer used for all connections to Minidisc registries,
+// e.g. to route them through a tsnet.Server instead of the OS network stack.
+func SetDialer(d Dialer) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	dialer = d
+}
+
+// currentDialer returns the dialer set with SetDialer.
+func currentDialer() Dialer {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	return dialer
+}
+
+// transport is shared by all HTTP traffic to Minidisc registries, so that
+// connections get reused across queries. It looks up the dialer on every
+// connection, so SetDialer takes effect at once.
+var transport = &http.Transport{
+	DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return currentDialer()(ctx, network, addr)
+	},
+	MaxIdleConns:        256,
+	MaxIdleConnsPerHost: 4,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// client is used for all requests to Minidisc registries. It has no timeout of
+// its own; requests carry their deadline in their context instead.
+var client = &http.Client{Transport: transport}
+
+// newLeaderClient returns a client for a delegate's requests to its leader. It
+// has a transport of its own, so the one connection it keeps alive between
+// watchdog pings isn't evicted by other traffic. Once the leader goes away,
+// that connection breaks and the next ping has to dial again, which fails.
+func newLeaderClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return currentDialer()(ctx, network, addr)
+		},
+		MaxIdleConnsPerHost: 1,
+		IdleConnTimeout:     serverIdleTimeout,
+	}}
+}
+
+// clientAuthToken is sent by ListServices and FindService to authenticate with
+// remote registries.
+var clientAuthToken string
+
+// SetAuthToken sets the shared secret that ListServices and FindService send to
+// remote registries. It must match the AuthToken the registries were started
+// with. An empty token (the default) disables authentication.
+func SetAuthToken(token string) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	clientAuthToken = token
+}
+
+// currentAuthToken returns the token set with SetAuthToken.
+func currentAuthToken() string {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	return clientAuthToken
+}
+
+// newRequest creates an HTTP request to a Minidisc registry. If token is
+// non-empty, it's attached as a bearer token.
+func newRequest(
+	ctx context.Context, method, url, token string, body io.Reader,
+) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// Protocol versioning /////////////////////////////////////////////////////////
+
+// ProtocolVersion is the version of the /services wire format this package
+// speaks. Registries and clients announce it in the X-Minidisc-Version header,
+// and the serving side answers in the highest version both sides understand.
+// A missing or malformed header means version 1, which predates the header.
+//
+// Version 2 adds services without a TCP address, which version 1 peers don't
+// receive.
+const ProtocolVersion = 2
+
+const versionHeader = "X-Minidisc-Version"
+
+// negotiateVersion returns the protocol version to use with a peer that sent
+// header h.
+func negotiateVersion(h http.Header) int {
+	v, err := strconv.Atoi(h.Get(versionHeader))
+	if err != nil || v < 1 {
+		return 1
+	}
+	return min(v, ProtocolVersion)
+}
+
+// encodeServices serializes a service list in the given protocol version.
+func encodeServices(services []Service, version int) ([]byte, error) {
+	if version < 2 {
+		services = slices.DeleteFunc(slices.Clone(services), func(s Service) bool {
+			return !s.AddrPort.IsValid()
+		})
+	}
+	return json.Marshal(services)
+}
+
+// decodeServices parses a service list in the given protocol version. Invalid
+// entries, which only buggy or incompatible registries send, are dropped. This
+// includes services without a TCP address in version 1, which can't have them.
+func decodeServices(data []byte, version int) ([]Service, error) {
+	var services []Service
+	if err := json.Unmarshal(data, &services); err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(services, func(s Service) bool {
+		if version < 2 && !s.AddrPort.IsValid() {
+			logger.Debugf("Dropping service %v without address in protocol version %d", s, version)
+			return true
+		}
+		if err := validateService(s); err != nil {
+			logger.Debugf("Dropping invalid service %v: %v", s, err)
+			return true
+		}
+		return false
+	}), nil
 }
 
 // Read API ////////////////////////////////////////////////////////////////////
 
+var (
+	// ErrServiceNotFound means that discovery worked, but no advertised service
+	// matched the request.
+	ErrServiceNotFound = errors.New("No matching service found")
+	// ErrTailnetUnavailable means that the Tailnet status couldn't be read,
+	// e.g. because tailscaled isn't running.
+	ErrTailnetUnavailable = errors.New("Tailnet unavailable")
+)
+
+const (
+	// DefaultPort is the port that leader registries serve on, and that
+	// queries go to, unless configured otherwise. Registries and clients only
+	// see each other if they use the same port.
+	DefaultPort uint16 = 28004
+	// DefaultQueryTimeout is how long queries to a single registry may take
+	// unless configured otherwise.
+	DefaultQueryTimeout = 2 * time.Second
+	// MinQueryTimeout is the lower bound for configured query timeouts.
+	MinQueryTimeout = 100 * time.Millisecond
+	// DefaultQueryConcurrency is how many registries are queried at the same
+	// time unless configured otherwise.
+	DefaultQueryConcurrency = 32
+	// DefaultMaxResponseSize is the largest service list accepted from a
+	// registry unless configured otherwise.
+	DefaultMaxResponseSize = 4 << 20
+)
+
+var (
+	queryTimeout    = DefaultQueryTimeout
+	maxResponseSize = int64(DefaultMaxResponseSize)
+)
+
+// SetQueryTimeout sets how long ListServices and FindService wait for each
+// registry on the Tailnet. Values below MinQueryTimeout are raised to it.
+func SetQueryTimeout(timeout time.Duration) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	queryTimeout = max(timeout, MinQueryTimeout)
+}
+
+// currentQueryTimeout returns the timeout set with SetQueryTimeout.
+func currentQueryTimeout() time.Duration {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	return queryTimeout
+}
+
+// SetMaxResponseSize sets the largest service list, in bytes after
+// decompression, that is accepted from a registry. Larger responses are
+// treated as errors, so a broken or malicious registry can't exhaust memory.
+func SetMaxResponseSize(size int64) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	maxResponseSize = size
+}
+
+// currentMaxResponseSize returns the size set with SetMaxResponseSize.
+func currentMaxResponseSize() int64 {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	return maxResponseSize
+}
+
+// QueryOptions customizes individual ListServices and FindService calls. The
+// zero value gives the default behavior.
+type QueryOptions struct {
+	// Timeout for the query to each registry. Zero means the timeout set with
+	// SetQueryTimeout. Values below MinQueryTimeout are raised to it.
+	Timeout time.Duration
+	// Hosts to query instead of all nodes on the Tailnet. Use this as a hint
+	// when the wanted services are known to run on a few machines.
+	Hosts []netip.Addr
+	// Concurrency is the maximum number of registries queried at the same
+	// time. Zero means DefaultQueryConcurrency. Registries beyond that wait for
+	// their turn, so with hung registries, the query can take up to Timeout for
+	// each batch of Concurrency registries.
+	Concurrency int
+	// PeerTags, if set, restricts the query to peers with at least one of
+	// these ACL tags, e.g. "tag:server", plus the local host. This saves
+	// querying e.g. laptops on Tailnets where only servers run registries.
+	PeerTags []string
+	// Port is where to query the registries. Zero means DefaultPort.
+	Port uint16
+	// LocalFirst returns services in the order their hosts were queried,
+	// instead of sorted: the local host first, then peers in the order of the
+	// Tailscale status. FindService prefers services in this order, so clients
+	// use local instances if there are any, and otherwise spread out.
+	LocalFirst bool
+}
+
+// timeout returns the effective query timeout for these options.
+func (o QueryOptions) timeout() time.Duration {
+	if o.Timeout == 0 {
+		return currentQueryTimeout()
+	}
+	return max(o.Timeout, MinQueryTimeout)
+}
+
+// port returns the effective registry port for these options.
+func (o QueryOptions) port() uint16 {
+	if o.Port == 0 {
+		return DefaultPort
+	}
+	return o.Port
+}
+
+// concurrency returns the effective number of parallel queries.
+func (o QueryOptions) concurrency() int {
+	if o.Concurrency <= 0 {
+		return DefaultQueryConcurrency
+	}
+	return o.Concurrency
+}
+
 // ListServices queries and combines the advertised services from all Minidisc
-// registries on the Tailnet.
+// registries on the Tailnet. The result is sorted by name, then by address (see
+// CompareServices), unless QueryOptions.LocalFirst is set.
 func ListServices() ([]Service, error) {
+	return ListServicesWithOptions(QueryOptions{})
+}
+
+// ListServicesWithOptions is like ListServices, but allows customizing the
+// query.
+func ListServicesWithOptions(opts QueryOptions) ([]Service, error) {
+	return ListServicesContext(context.Background(), opts)
+}
+
+// ListServicesContext is like ListServicesWithOptions, but gives up when ctx is
+// done, and traces the query as part of the span in ctx, if any.
+func ListServicesContext(ctx context.Context, opts QueryOptions) (ss []Service, err error) {
+	ctx, span := GetTracer().Start(ctx, "minidisc.ListServices")
+	defer func() {
+		span.SetAttribute("minidisc.service_count", len(ss))
+		endSpan(span, err)
+	}()
+	addrs := opts.Hosts
+	if len(addrs) == 0 {
+		// List IPv4 addresses of online nodes on the Tailnet.
+		addrs, err = listTailnetAddrs(opts.PeerTags...)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrTailnetUnavailable, err)
+		}
+	}
+	span.SetAttribute("minidisc.peer_count", len(addrs))
+	return listServicesFrom(ctx, addrs, opts)
+}
+
+// ListServicesFrom is like ListServices, but only queries the registries on
+// the given hosts rather than all nodes on the Tailnet.
+func ListServicesFrom(addrs []netip.Addr) ([]Service, error) {
+	return listServicesFrom(context.Background(), addrs, QueryOptions{})
+}
+
+// listServicesFrom queries the registries on addrs in parallel, but no more
+// than opts.concurrency() at a time.
+func listServicesFrom(
+	ctx context.Context, addrs []netip.Addr, opts QueryOptions,
+) ([]Service, error) {
 	var results []Service
-	var channels []chan []Service
-	// List IPv4 addresses of online nodes on the Tailnet.
-	addrs, err := listTailnetAddrs()
+	addrs = slices.DeleteFunc(slices.Clone(addrs), func(addr netip.Addr) bool {
+		return recentlyRefused(netip.AddrPortFrom(addr, opts.port()))
+	})
+	// Kick off a pool of workers to query the addresses. The channel has room
+	// for all answers, so late ones don't block once we've stopped waiting.
+	type answer struct {
+		index    int
+		services []Service
+	}
+	answers := make(chan answer, len(addrs))
+	jobs := make(chan int, len(addrs))
+	for i := range addrs {
+		jobs <- i
+	}
+	close(jobs)
+	// Cancel queries that are still running when we return.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	workers := min(opts.concurrency(), len(addrs))
+	for range workers {
+		go func() {
+			for i := range jobs {
+				ap := netip.AddrPortFrom(addrs[i], opts.port())
+				services, err := getRemoteServices(ctx, ap, currentAuthToken(), opts.timeout())
+				switch {
+				case err == nil:
+					services = withDefaultSource(services, ap)
+				case ctx.Err() != nil:
+					// We've stopped waiting, no need to complain.
+				case !isUrlError(err):
+					logger.Warnf("Error fetching services from %s: %v", ap.String(), err)
+				default:
+					logger.Debugf("Error connecting to %s: %v", ap.String(), err)
+					if errors.Is(err, syscall.ECONNREFUSED) {
+						markRefused(ap)
+					}
+				}
+				answers <- answer{i, services}
+			}
+		}()
+	}
+	// Wait for the answers, but not longer than it takes the workers to time
+	// out on every registry in turn, so hung registries can't stall the whole
+	// query, but also don't keep the ones queued behind them from being heard.
+	// Concatenate them in the order of addrs.
+	parts := make([][]Service, len(addrs))
+	var rounds int
+	if workers > 0 {
+		rounds = (len(addrs) + workers - 1) / workers
+	}
+	wait := time.Duration(rounds) * opts.timeout()
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+wait:
+	for pending := len(addrs); pending > 0; pending-- {
+		select {
+		case a := <-answers:
+			parts[a.index] = a.services
+		case <-deadline.C:
+			logger.Warnf("%d registries didn't answer within %v", pending, wait)
+			break wait
+		}
+	}
+	results = slices.Concat(parts...)
+	results = dedupeServices(results)
+	if !opts.LocalFirst {
+		slices.SortStableFunc(results, CompareServices)
+	}
+	for _, group := range findAmbiguous(results) {
+		warnAmbiguous(group)
+	}
+	return results, nil
+}
+
+// warnedAmbiguous holds the groups of services that warnAmbiguous has warned
+// about.
+var warnedAmbiguous sync.Map
+
+// warnAmbiguous warns that the services in group can't be told apart. As
+// clients like Cache query every few seconds, it only warns once per group.
+func warnAmbiguous(group []Service) {
+	var addrs []string
+	for _, s := range group {
+		addrs = append(addrs, s.AddrPort.String())
+	}
+	key := group[0].Name + " " + canonicalLabels(group[0].Labels) + " " +
+		strings.Join(addrs, ",")
+	if _, warned := warnedAmbiguous.LoadOrStore(key, true); !warned {
+		logger.Warnf(
+			"Service %s with labels %v is advertised at several addresses: %s",
+			group[0].Name, group[0].Labels, strings.Join(addrs, ", "),
+		)
+	}
+}
+
+// CompareServices orders services by name, then by address, then by target for
+// services without an address. It returns a negative number if a comes first, a
+// positive one if b does, and 0 if they're equal in this order. It's suitable
+// for slices.SortFunc.
+func CompareServices(a, b Service) int {
+	if c := strings.Compare(a.Name, b.Name); c != 0 {
+		return c
+	}
+	if c := a.AddrPort.Compare(b.AddrPort); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Target, b.Target)
+}
+
+// refusedCooldown is how long ListServices skips peers that refused a
+// connection. A refused connection means there's no registry on that host and
+// port, and it's unlikely one starts within that time.
+const refusedCooldown = 30 * time.Second
+
+var (
+	refusedMutex sync.Mutex
+	refusedUntil = make(map[netip.AddrPort]time.Time)
+)
+
+// markRefused records that ap refused a connection just now. Other ports on
+// the same host may still have registries, e.g. for another mesh.
+func markRefused(ap netip.AddrPort) {
+	refusedMutex.Lock()
+	defer refusedMutex.Unlock()
+	refusedUntil[ap] = time.Now().Add(refusedCooldown)
+}
+
+// recentlyRefused reports whether ap refused a connection within the
+// cooldown, so querying it again would be pointless.
+func recentlyRefused(ap netip.AddrPort) bool {
+	refusedMutex.Lock()
+	defer refusedMutex.Unlock()
+	until, ok := refusedUntil[ap]
+	if ok && time.Now().After(until) {
+		delete(refusedUntil, ap)
+		return false
+	}
+	return ok
+}
+
+// findAmbiguous returns groups of services that share name and labels but have
+// different addresses. FindService can't tell these apart, so it returns
+// whichever responds first.
+func findAmbiguous(ss []Service) [][]Service {
+	groups := make(map[string][]Service)
+	var keys []string
+	for _, s := range ss {
+		key := s.Name + " " + canonicalLabels(s.Labels)
+		if !slices.ContainsFunc(groups[key], func(o Service) bool {
+			return o.AddrPort == s.AddrPort
+		}) {
+			if len(groups[key]) == 0 {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], s)
+		}
+	}
+	var result [][]Service
+	for _, key := range keys {
+		if len(groups[key]) > 1 {
+			result = append(result, groups[key])
+		}
+	}
+	return result
+}
+
+// canonicalLabels returns a string representation of labels that's identical
+// for identical label sets.
+func canonicalLabels(labels map[string]string) string {
+	var parts []string
+	for k, v := range labels {
+		parts = append(parts, strconv.Quote(k)+"="+strconv.Quote(v))
+	}
+	slices.Sort(parts)
+	return strings.Join(parts, ",")
+}
+
+// FindService tries to find a service that matches the name and the given
+// labels. If several services match, it prefers those on the local host, see
+// QueryOptions.LocalFirst.
+// Only requested labels get compared - if the request asks for env=prod, this
+// will match [env=prod], [env=prod, foo=bar], but not [env=staging]. A label
+// value of AnyLabelValue matches any value, as long as the label exists.
+//
+// If nothing matches, the error wraps ErrServiceNotFound. If the Tailnet can't
+// be queried at all, it wraps ErrTailnetUnavailable.
+func FindService(name string, labels map[string]string) (netip.AddrPort, error) {
+	return FindServiceWithOptions(name, labels, QueryOptions{})
+}
+
+// FindServiceWithOptions is like FindService, but allows customizing the query.
+func FindServiceWithOptions(
+	name string, labels map[string]string, opts QueryOptions,
+) (netip.AddrPort, error) {
+	opts.LocalFirst = true
+	ss, err := ListServicesWithOptions(opts)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if ap, ok := firstMatch(ss, name, labels); ok {
+		return ap, nil
+	}
+	return netip.AddrPort{}, fmt.Errorf("%w for %s", ErrServiceNotFound, name)
+}
+
+// FindServiceWait is like FindService, but if no service matches or the Tailnet
+// can't be queried, it tries again with exponential backoff until it succeeds
+// or ctx is done. This helps programs that start along with the services they
+// depend on. When ctx is done, the error wraps both ctx.Err() and the error of
+// the last attempt.
+func FindServiceWait(
+	ctx context.Context, name string, labels map[string]string,
+) (netip.AddrPort, error) {
+	var ap netip.AddrPort
+	err := retryFind(ctx, name, func(ss []Service) error {
+		var ok bool
+		if ap, ok = firstMatch(ss, name, labels); !ok {
+			return fmt.Errorf("%w for %s", ErrServiceNotFound, name)
+		}
+		return nil
+	})
+	return ap, err
+}
+
+// FindServicesMin is like FindServiceWait, but waits until at least minCount
+// services match, e.g. the replicas a client needs for a quorum, and returns
+// all of them, local ones first like FindService. While fewer match, the error
+// of the attempt wraps ErrServiceNotFound.
+func FindServicesMin(
+	ctx context.Context, name string, labels map[string]string, minCount int,
+) ([]Service, error) {
+	var matches []Service
+	err := retryFind(ctx, name, func(ss []Service) error {
+		matches = nil
+		for _, s := range ss {
+			if serviceMatches(s, name, labels) {
+				matches = append(matches, s)
+			}
+		}
+		if len(matches) < minCount {
+			return fmt.Errorf(
+				"%w: %d of %d instances of %s", ErrServiceNotFound, len(matches), minCount, name,
+			)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// maxFindBackoff caps the delay between attempts in retryFind.
+const maxFindBackoff = 5 * time.Second
+
+// retryFind lists services and passes them to check until it returns nil,
+// with exponential backoff in between. Once ctx is done, it returns an error
+// wrapping ctx.Err() and the last error from listing or check.
+func retryFind(ctx context.Context, name string, check func([]Service) error) error {
+	backoff := 250 * time.Millisecond
+	for {
+		ss, err := ListServicesContext(ctx, QueryOptions{LocalFirst: true})
+		if err == nil {
+			if err = check(ss); err == nil {
+				return nil
+			}
+		}
+		logger.Infof("Waiting %v for service %s: %v", backoff, name, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxFindBackoff)
+	}
+}
+
+// Ping checks that a Minidisc registry answers at ap, using the same endpoint as
+// the liveness checks between registries, and returns the round-trip time.
+func Ping(ap netip.AddrPort) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), currentQueryTimeout())
+	defer cancel()
+	return pingContext(ctx, ap, currentAuthToken())
+}
+
+// pingContext is like Ping, but takes the deadline from ctx and authenticates
+// with token.
+func pingContext(ctx context.Context, ap netip.AddrPort, token string) (time.Duration, error) {
+	req, err := newRequest(ctx, "GET", fmt.Sprintf("http://%s/ping", ap), token, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	rtt := time.Since(start)
+	if resp.StatusCode != http.StatusOK {
+		return rtt, fmt.Errorf("%s from %s", resp.Status, ap)
+	}
+	if resp.Header.Get(versionHeader) == "" {
+		return rtt, fmt.Errorf("No Minidisc registry at %s", ap)
+	}
+	return rtt, nil
+}
+
+// HealthCheck returns nil if discovery works as far as this process can tell:
+// the Tailnet status can be read, and all registries started in this process
+// that haven't been closed are serving. Otherwise, it returns an error saying
+// what's wrong, e.g. for a readiness probe of a service that relies on
+// Minidisc.
+func HealthCheck(ctx context.Context) error {
+	if _, err := CurrentTailnet(); err != nil {
+		return err
+	}
+	for _, r := range runningRegistries() {
+		if err := r.HealthCheck(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LookupByAddr returns all services advertised at ap, e.g. to find out what a
+// connection in a log belongs to. There can be several, with different names or
+// labels. If there are none, the error wraps ErrServiceNotFound.
+func LookupByAddr(ap netip.AddrPort) ([]Service, error) {
+	return lookupServices(ap.String(), func(s Service) bool {
+		return s.AddrPort == ap
+	})
+}
+
+// LookupByHost returns all services advertised on addr, on any port. Unix
+// socket services aren't included, since they have no address. If there are
+// none, the error wraps ErrServiceNotFound.
+func LookupByHost(addr netip.Addr) ([]Service, error) {
+	return lookupServices(addr.String(), func(s Service) bool {
+		return s.AddrPort.IsValid() && s.AddrPort.Addr() == addr
+	})
+}
+
+// lookupServices returns the advertised services for which keep returns true,
+// or an error mentioning where if there are none.
+func lookupServices(where string, keep func(Service) bool) ([]Service, error) {
+	ss, err := ListServices()
 	if err != nil {
-		return results, err
+		return nil, err
+	}
+	var result []Service
+	for _, s := range ss {
+		if keep(s) {
+			result = append(result, s)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w at %s", ErrServiceNotFound, where)
+	}
+	return result, nil
+}
+
+// dedupeServices removes services that were listed more than once by the same
+// registry, keeping the first. That happens e.g. if the local host shows up
+// among its own peers, or a delegate is reachable through several paths.
+func dedupeServices(services []Service) []Service {
+	type key struct {
+		source       netip.AddrPort
+		target, name string
+	}
+	seen := make(map[key]bool)
+	return slices.DeleteFunc(services, func(s Service) bool {
+		k := key{s.Source, s.Target, s.Name}
+		if seen[k] {
+			return true
+		}
+		seen[k] = true
+		return false
+	})
+}
+
+// withDefaultSource sets the Source of services that don't have one, because
+// the registry serving them predates that field.
+func withDefaultSource(services []Service, source netip.AddrPort) []Service {
+	result := slices.Clone(services)
+	for i := range result {
+		if !result[i].Source.IsValid() {
+			result[i].Source = source
+		}
+	}
+	return result
+}
+
+// getRemoteServices fetches advertised services from a remote registry,
+// authenticating with token unless it's empty, and giving up after timeout or
+// when ctx is done.
+//
+// Responses are gzip-compressed in transit and cached by ETag, so if the remote
+// list hasn't changed since the last call, it's neither transferred nor decoded
+// again.
+func getRemoteServices(
+	ctx context.Context, ap netip.AddrPort, token string, timeout time.Duration,
+) (result []Service, err error) {
+	ctx, span := GetTracer().Start(ctx, "minidisc.getRemoteServices")
+	span.SetAttribute("minidisc.peer", ap.String())
+	defer func() {
+		span.SetAttribute("minidisc.service_count", len(result))
+		endSpan(span, err)
+	}()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	url := fmt.Sprintf("http://%s/services", ap.String())
+	req, err := newRequest(ctx, "GET", url, token, nil)
+	if err != nil {
+		return result, err
+	}
+	// Setting this explicitly disables the transport's implicit decompression,
+	// so we need to handle that ourselves below.
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set(versionHeader, strconv.Itoa(ProtocolVersion))
+	key := responseKey{addrPort: ap, version: ProtocolVersion, token: token}
+	if path, ok := ctx.Value(pathKey{}).([]netip.AddrPort); ok {
+		key.path = formatPath(path)
+		req.Header.Set(pathHeader, key.path)
+	}
+	GetTracer().Inject(ctx, req.Header)
+	cached, haveCached := responseCache.get(key)
+	if haveCached {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && haveCached {
+		return cached.services, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("%s while fetching services", resp.Status)
+	}
+	var bodyReader io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return result, err
+		}
+		defer gz.Close()
+		bodyReader = gz
+	}
+	limit := currentMaxResponseSize()
+	body, err := io.ReadAll(io.LimitReader(bodyReader, limit+1))
+	if err != nil {
+		return result, err
+	}
+	if int64(len(body)) > limit {
+		return result, fmt.Errorf("Response from %s exceeds %d bytes", ap, limit)
+	}
+	result, err = decodeServices(body, negotiateVersion(resp.Header))
+	if err != nil {
+		return result, err
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		responseCache.put(key, cachedResponse{etag: etag, services: result})
+	}
+	return result, nil
+}
+
+// cachedResponse is the last service list received from a remote registry.
+type cachedResponse struct {
+	etag     string
+	services []Service
+}
+
+// responseKey holds everything a request sends that can change the response.
+type responseKey struct {
+	addrPort netip.AddrPort
+	version  int
+	path     string
+	token    string
+}
+
+// maxCachedResponses bounds the number of entries in responseCache.
+const maxCachedResponses = 1024
+
+// serviceCache maps requests to remote registries to their last response.
+// When full, it evicts an arbitrary entry, which at worst costs that registry
+// a full response on the next request.
+type serviceCache struct {
+	mutex   sync.Mutex
+	entries map[responseKey]cachedResponse
+	max     int
+}
+
+var responseCache = &serviceCache{
+	entries: make(map[responseKey]cachedResponse),
+	max:     maxCachedResponses,
+}
+
+// get returns a copy of the cached response for key, so callers may modify it.
+func (c *serviceCache) get(key responseKey) (cachedResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cr, ok := c.entries[key]
+	cr.services = cloneServices(cr.services)
+	return cr, ok
+}
+
+func (c *serviceCache) put(key responseKey, cr cachedResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	cr.services = cloneServices(cr.services)
+	c.entries[key] = cr
+}
+
+// cloneServices copies ss along with the slices and maps of each service.
+func cloneServices(ss []Service) []Service {
+	if ss == nil {
+		return nil
+	}
+	result := make([]Service, len(ss))
+	for i, s := range ss {
+		s.Aliases = slices.Clone(s.Aliases)
+		s.Labels = maps.Clone(s.Labels)
+		s.Annotations = maps.Clone(s.Annotations)
+		result[i] = s
+	}
+	return result
+}
+
+func isUrlError(err error) bool {
+	_, ok := err.(*url.Error)
+	return ok
+}
+
+// Local Registry API //////////////////////////////////////////////////////////
+
+// Registry is the local interface to the Minidisc service discovery. It
+// maintains and advertises a list of services that the current process offers.
+//
+// Each Registry is an independent node of the discovery network and owns the
+// services advertised through it. A process can run several of them: the
+// first one on the host becomes the leader, all others register with it as
+// delegates, exactly as if they were running in separate processes. Most
+// programs only need one, though, which SharedRegistry provides.
+type Registry struct {
+	http.Handler
+
+	mutex sync.Mutex
+	// The local Tailnet IPv4 address of the local host. We set this at init
+	// time to be robust against host's admin switching to a different Tailnet.
+	localAddr netip.Addr
+	// Where the registry learns about the Tailnet.
+	status StatusProvider
+	// The port the leader serves on.
+	port uint16
+	// The address the registry is currently serving on, as leader or delegate.
+	addr          netip.AddrPort
+	localServices []Service
+	delegates     []netip.AddrPort
+	// Cancels forwarding the events of each delegate, see forwardEvents.
+	forwards map[netip.AddrPort]context.CancelFunc
+	// Registries on other hosts whose services we list as our own.
+	upstreams []netip.AddrPort
+	// Shared secret required on incoming requests, and sent on outgoing ones.
+	// Empty if authentication is disabled.
+	authToken string
+	// Limits requests per client, or nil for no limit.
+	limiter *rateLimiter
+	// Called when role changes, if set.
+	onRoleChange func(Role)
+	// Ports to try as delegate before falling back to an OS-assigned one,
+	// unless strictDelegatePorts is set.
+	delegatePortRange   [2]uint16
+	strictDelegatePorts bool
+	// Called for every request if set, see StartRegistryOptions.AccessLog.
+	accessLog func(req *http.Request, status int, dur time.Duration)
+	// Upper bound for len(delegates).
+	maxDelegates int
+	// How often the leader pings delegates to remove dead ones.
+	pruneInterval time.Duration
+	// Timeout for querying delegates' services.
+	queryTimeout time.Duration
+	// How often a delegate checks that the leader is alive, and how long it
+	// waits for an answer.
+	watchdogInterval  time.Duration
+	leaderPingTimeout time.Duration
+	// Used for all requests to the leader while a delegate.
+	leaderClient *http.Client
+	// When the registry was started.
+	startTime time.Time
+	// Random value chosen at startup and sent in nonceHeader, so peers can
+	// tell when the registry at an address was restarted.
+	nonce string
+	// While a delegate, the leader's nonce when we registered with it.
+	leaderNonce string
+	// Whether we're currently leader or delegate.
+	role Role
+	// While a delegate, our position in the leader's delegate list.
+	rank int
+	// Closed once the registry has first joined the network, or failed to.
+	ready     chan struct{}
+	readyOnce sync.Once
+	// Set before ready is closed if the registry can't join the network.
+	startErr error
+	// Closed by Close to stop all goroutines, and by connect when they have.
+	stop   chan struct{}
+	done   chan struct{}
+	closed bool
+	// The socket ServeDNS runs on, or nil if DNS is disabled.
+	dnsConn net.PacketConn
+	// Changes to stream on /events.
+	events eventLog
+}
+
+// Role describes a registry's place in the discovery network.
+type Role int
+
+const (
+	// RoleConnecting means that the registry is (re)joining the network.
+	RoleConnecting Role = iota
+	// RoleLeader means that the registry serves on the registry port, 28004
+	// unless configured otherwise, and forwards requests to the delegates on
+	// the same host.
+	RoleLeader
+	// RoleDelegate means that the registry serves on another port and is
+	// registered with the leader.
+	RoleDelegate
+)
+
+func (role Role) String() string {
+	switch role {
+	case RoleConnecting:
+		return "connecting"
+	case RoleLeader:
+		return "leader"
+	case RoleDelegate:
+		return "delegate"
+	default:
+		return "unknown"
+	}
+}
+
+// Role returns whether the registry is currently the leader on this host, a
+// delegate, or in between.
+func (r *Registry) Role() Role {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.role
+}
+
+// LeaderAddr returns the address of the leader this registry is registered
+// with. The bool is false unless the registry is a delegate.
+func (r *Registry) LeaderAddr() (netip.AddrPort, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.role != RoleDelegate {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(r.localAddr, r.port), true
+}
+
+// Addr returns the address the registry serves on: the registry port as
+// leader, or the port it got from the OS as delegate. It keeps the last address
+// while the registry reconnects, and is invalid before it first joined the
+// network.
+func (r *Registry) Addr() netip.AddrPort {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.addr
+}
+
+// setRole updates the registry's role, and tells the OnRoleChange callback if
+// it changed. The callback runs without holding the mutex, so it may call back
+// into the registry.
+func (r *Registry) setRole(role Role) {
+	r.mutex.Lock()
+	changed := role != r.role
+	r.role = role
+	r.mutex.Unlock()
+	if changed && r.onRoleChange != nil {
+		r.onRoleChange(role)
+	}
+}
+
+// StartRegistryOptions configures a Registry. The zero value gives the default
+// behavior of StartRegistry.
+type StartRegistryOptions struct {
+	// AuthToken, if set, is a shared secret that clients must present as a
+	// bearer token in the Authorization header. Requests without it are
+	// rejected with 401. All registries on the Tailnet need to use the same
+	// token, and clients need to call SetAuthToken.
+	AuthToken string
+	// MaxDelegates limits how many delegates a leader accepts. Zero means
+	// DefaultMaxDelegates.
+	MaxDelegates int
+	// PruneInterval is how often a leader pings its delegates to remove those
+	// that have gone away. Zero means DefaultPruneInterval.
+	PruneInterval time.Duration
+	// QueryTimeout is how long a leader waits for its delegates' services.
+	// Zero means DefaultQueryTimeout. Values below MinQueryTimeout are raised
+	// to it.
+	QueryTimeout time.Duration
+	// WatchdogInterval is how often a delegate checks that its leader is still
+	// alive. Zero means DefaultWatchdogInterval.
+	WatchdogInterval time.Duration
+	// LeaderPingTimeout is how long a delegate waits for the leader to answer
+	// a liveness check before it considers the leader gone. Zero means
+	// DefaultLeaderPingTimeout.
+	LeaderPingTimeout time.Duration
+	// StaticLocalAddr, if valid, makes the registry bypass Tailscale and bind
+	// to this address, with StaticPeers as the other hosts on the network. It
+	// takes precedence over StatusProvider. This only affects the registry;
+	// use SetStaticTailnet to make queries from the process use them, too.
+	StaticLocalAddr netip.Addr
+	StaticPeers     []netip.Addr
+	// StatusProvider, if set, is where the registry learns about the Tailnet,
+	// instead of the provider set with SetStatusProvider.
+	StatusProvider StatusProvider
+	// RequestsPerSecond, if positive, limits how often each remote address may
+	// query the registry; excess requests get "429 Too Many Requests". Pings
+	// and requests from the local host are exempt. By default, there's no
+	// limit, as e.g. aggregators legitimately query often.
+	RequestsPerSecond int
+	// AccessLog, if set, is called after every request the registry serves,
+	// with the response status and how long it took. The request's
+	// RemoteAddr is the client's Tailnet address.
+	AccessLog func(req *http.Request, status int, dur time.Duration)
+	// DelegatePortRange, if non-zero, is the inclusive range of ports to bind
+	// to as delegate, e.g. {28005, 28050} to allow them through a firewall. If
+	// they're all taken, the registry uses an OS-assigned port instead, unless
+	// StrictDelegatePorts is set. Then, StartRegistry fails. As leader, the
+	// registry accepts delegates from this range, so all registries on a host
+	// need the same one.
+	DelegatePortRange   [2]uint16
+	StrictDelegatePorts bool
+	// OnRoleChange, if set, is called whenever the registry's role changes:
+	// when it becomes leader or delegate, including when a delegate gets
+	// promoted after the leader went away, and when it starts reconnecting.
+	// It's called from the registry's background goroutine, in order, so it
+	// should return quickly.
+	OnRoleChange func(Role)
+	// WaitForTailscale is how long StartRegistry keeps retrying if the Tailnet
+	// status is unavailable, e.g. because tailscaled is still starting during
+	// boot. Zero means failing right away.
+	WaitForTailscale time.Duration
+	// Port is where the leader serves, and where delegates find it. Zero means
+	// DefaultPort. Registries on different ports form separate networks, e.g.
+	// for tests or for several tenants on the same Tailnet; clients need to
+	// query them with QueryOptions.Port.
+	Port uint16
+	// DNSAddr, if set, is the UDP address, e.g. "127.0.0.1:5353", where the
+	// registry answers DNS queries for services by name. See ServeDNS.
+	DNSAddr string
+}
+
+const (
+	// DefaultMaxDelegates is the default for StartRegistryOptions.MaxDelegates.
+	DefaultMaxDelegates = 64
+	// DefaultPruneInterval is the default for StartRegistryOptions.PruneInterval.
+	DefaultPruneInterval = 30 * time.Second
+	// DefaultWatchdogInterval is the default for
+	// StartRegistryOptions.WatchdogInterval.
+	DefaultWatchdogInterval = 5 * time.Second
+	// DefaultLeaderPingTimeout is the default for
+	// StartRegistryOptions.LeaderPingTimeout.
+	DefaultLeaderPingTimeout = 1 * time.Second
+)
+
+// StartRegistry creates a local Minidisc registry and starts the goroutines
+// that keep it up-to-date and connected to other registries on the Tailnet. It
+// returns once the registry has joined the network as leader or delegate.
+//
+// Every call starts a new, independent registry; see SharedRegistry for one
+// that's started once per process.
+func StartRegistry() (*Registry, error) {
+	return StartRegistryWithOptions(StartRegistryOptions{})
+}
+
+// SharedRegistry returns the process-wide registry, starting it on first use.
+// Unlike StartRegistry, calling it repeatedly always returns the same registry,
+// which makes it safe to use from independent parts of a program.
+func SharedRegistry() (*Registry, error) {
+	sharedRegistryMutex.Lock()
+	defer sharedRegistryMutex.Unlock()
+	if sharedRegistry == nil {
+		r, err := StartRegistry()
+		if err != nil {
+			return nil, err
+		}
+		sharedRegistry = r
+	}
+	return sharedRegistry, nil
+}
+
+var (
+	sharedRegistryMutex sync.Mutex
+	sharedRegistry      *Registry
+)
+
+// registries holds the registries that were started and not closed yet, for
+// HealthCheck.
+var (
+	registriesMutex sync.Mutex
+	registries      = make(map[*Registry]struct{})
+)
+
+// runningRegistries returns the registries that were started and not closed
+// yet.
+func runningRegistries() []*Registry {
+	registriesMutex.Lock()
+	defer registriesMutex.Unlock()
+	return slices.Collect(maps.Keys(registries))
+}
+
+// maxTailnetBackoff caps the delay between attempts in waitForTailnet.
+const maxTailnetBackoff = 5 * time.Second
+
+// waitForTailnet gets the Tailnet map from status, retrying with exponential
+// backoff for up to wait if it's unavailable, or until ctx is done.
+func waitForTailnet(
+	ctx context.Context, status StatusProvider, wait time.Duration,
+) (TailnetMap, error) {
+	deadline := time.Now().Add(wait)
+	backoff := 250 * time.Millisecond
+	for {
+		tmap, err := status.TailnetMap()
+		remaining := time.Until(deadline)
+		if err == nil || remaining <= 0 {
+			return tmap, err
+		}
+		delay := min(backoff, remaining)
+		logger.Infof("Waiting %v for Tailscale: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return tmap, err
+		case <-time.After(delay):
+		}
+		backoff = min(2*backoff, maxTailnetBackoff)
+	}
+}
+
+// StartRegistryWithOptions is like StartRegistry, but allows customizing the
+// registry's behavior.
+func StartRegistryWithOptions(opts StartRegistryOptions) (*Registry, error) {
+	return StartRegistryContext(context.Background(), opts)
+}
+
+// StartRegistryContext is like StartRegistryWithOptions, but ties the registry
+// to ctx. If ctx is done before the registry has joined the network, it gives
+// up and returns ctx.Err(). Afterwards, cancelling ctx has the same effect as
+// calling Close.
+func StartRegistryContext(ctx context.Context, opts StartRegistryOptions) (*Registry, error) {
+	if first, last := opts.DelegatePortRange[0], opts.DelegatePortRange[1]; (first != 0 || last != 0) &&
+		(first == 0 || first > last) {
+		return nil, fmt.Errorf("Bad delegate port range %d-%d", first, last)
+	}
+	status := opts.StatusProvider
+	if opts.StaticLocalAddr.IsValid() {
+		status = StaticStatusProvider{Map: TailnetMap{
+			LocalAddr: opts.StaticLocalAddr,
+			PeerAddrs: slices.Clone(opts.StaticPeers),
+		}}
+	} else if status == nil {
+		status = currentStatusProvider()
+	}
+	tmap, err := waitForTailnet(ctx, status, opts.WaitForTailscale)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTailnetUnavailable, err)
+	}
+	r := &Registry{
+		localAddr:     tmap.LocalAddr,
+		port:          opts.Port,
+		status:        status,
+		localServices: []Service{}, // Empty list, but JSON marshal-able.
+		authToken:     opts.AuthToken,
+		accessLog:     opts.AccessLog,
+		maxDelegates:  opts.MaxDelegates,
+		pruneInterval: opts.PruneInterval,
+		queryTimeout:  opts.QueryTimeout,
+		leaderClient:  newLeaderClient(),
+		startTime:     time.Now(),
+		nonce:         strconv.FormatUint(rand.Uint64(), 16),
+		ready:         make(chan struct{}),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+
+		watchdogInterval:    opts.WatchdogInterval,
+		leaderPingTimeout:   opts.LeaderPingTimeout,
+		onRoleChange:        opts.OnRoleChange,
+		delegatePortRange:   opts.DelegatePortRange,
+		strictDelegatePorts: opts.StrictDelegatePorts,
+	}
+	if r.port == 0 {
+		r.port = DefaultPort
+	}
+	if r.maxDelegates <= 0 {
+		r.maxDelegates = DefaultMaxDelegates
+	}
+	if r.pruneInterval <= 0 {
+		r.pruneInterval = DefaultPruneInterval
+	}
+	if r.queryTimeout == 0 {
+		r.queryTimeout = DefaultQueryTimeout
+	}
+	r.queryTimeout = max(r.queryTimeout, MinQueryTimeout)
+	if r.watchdogInterval <= 0 {
+		r.watchdogInterval = DefaultWatchdogInterval
+	}
+	if r.leaderPingTimeout <= 0 {
+		r.leaderPingTimeout = DefaultLeaderPingTimeout
+	}
+	if opts.RequestsPerSecond > 0 {
+		r.limiter = newRateLimiter(opts.RequestsPerSecond)
 	}
-	// Kick off queries to each of them in parallel.
-	for _, addr := range addrs {
-		ap := netip.AddrPortFrom(addr, 28004)
-		ch := make(chan []Service)
-		channels = append(channels, ch)
+	if opts.DNSAddr != "" {
+		if r.dnsConn, err = net.ListenPacket("udp", opts.DNSAddr); err != nil {
+			return nil, fmt.Errorf("Cannot serve DNS: %v", err)
+		}
 		go func() {
-			defer close(ch)
-			if services, err := getRemoteServices(ap); err == nil {
-				ch <- services
-			} else if !isUrlError(err) {
-				logger.Warnf("Error fetching services from %s: %v", ap.String(), err)
-			} else {
-				logger.Debugf("Error connecting to %s: %v", ap.String(), err)
+			// Wait for the registry to serve, so the first snapshot includes
+			// its services.
+			select {
+			case <-r.ready:
+			case <-r.stop:
+				return
+			}
+			if r.startErr != nil {
+				return
+			}
+			opts := QueryOptions{Port: r.port, Timeout: r.queryTimeout}
+			if err := ServeDNSWithOptions(r.dnsConn, opts); err != nil {
+				logger.Errorf("DNS server failed: %v", err)
 			}
 		}()
 	}
-	// Wait for and concatenate the results.
-	for _, ch := range channels {
-		if part, ok := <-ch; ok {
-			results = slices.Concat(results, part)
-		}
+	logger.Infof("Starting Minidisc registry")
+	go r.connect()
+	// Wait until we're either the leader or registered with it, so services
+	// are discoverable as soon as they're advertised.
+	select {
+	case <-r.ready:
+	case <-ctx.Done():
+		r.Close()
+		return nil, ctx.Err()
 	}
-	return results, nil
-}
-
-// FindService tries to find a service that matches the name and the given
-// labels. If several services match, it returns the first one to be found.
-// Only requested labels get compared - if the request asks for env=prod, this
-// will match [env=prod], [env=prod, foo=bar], but not [env=staging].
-func FindService(name string, labels map[string]string) (netip.AddrPort, error) {
-	ss, err := ListServices()
-	if err != nil {
-		return netip.AddrPort{}, err
+	if r.startErr != nil {
+		r.closeDNS()
+		return nil, r.startErr
 	}
-	for _, s := range ss {
-		if serviceMatches(s, name, labels) {
-			return s.AddrPort, nil
-		}
+	registriesMutex.Lock()
+	registries[r] = struct{}{}
+	registriesMutex.Unlock()
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				r.Close()
+			case <-r.stop:
+			}
+		}()
 	}
-	return netip.AddrPort{}, fmt.Errorf("No matching service found")
+	return r, nil
 }
 
-// getRemoteServices fetches advertised services from a remote registry.
-func getRemoteServices(ap netip.AddrPort) ([]Service, error) {
-	var result []Service
-	c := http.Client{Timeout: 2 * time.Second}
-	url := fmt.Sprintf("http://%s/services", ap.String())
-	resp, err := c.Get(url)
-	if err != nil {
-		return result, err
-	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+// AdvertiseService adds a local service to the list this registry advertises.
+// Label values can refer to host-specific variables such as "{{hostname}}",
+// see LabelVarHostname and friends.
+func (r *Registry) AdvertiseService(
+	port uint16, name string, labels map[string]string, opts ...ServiceOption,
+) error {
+	ap := netip.AddrPortFrom(r.localAddr, port)
+	return r.addService(ap, tcpTarget(ap), name, labels, opts)
+}
+
+// listenerCheckTimeout is how long AdvertiseServiceChecked waits to connect to
+// the service.
+const listenerCheckTimeout = 1 * time.Second
+
+// AdvertiseServiceChecked is like AdvertiseService, but first connects to the
+// service to make sure that something is listening on port. This catches
+// services that crashed or never started, which clients would otherwise only
+// notice when they fail to connect.
+func (r *Registry) AdvertiseServiceChecked(
+	port uint16, name string, labels map[string]string, opts ...ServiceOption,
+) error {
+	ap := netip.AddrPortFrom(r.localAddr, port)
+	ctx, cancel := context.WithTimeout(context.Background(), listenerCheckTimeout)
+	defer cancel()
+	conn, err := currentDialer()(ctx, "tcp", ap.String())
 	if err != nil {
-		return result, err
+		return fmt.Errorf("Nothing listening on %s: %v", ap, err)
 	}
-	err = json.Unmarshal(body, &result)
-	return result, err
+	conn.Close()
+	return r.addService(ap, tcpTarget(ap), name, labels, opts)
 }
 
-func isUrlError(err error) bool {
-	_, ok := err.(*url.Error)
-	return ok
+// AdvertiseRemoteService adds a remote service to the list this registry
+// advertises. You should only do this to include services that aren't minidisc
+// enabled themselves. Unlike with AdvertiseService, label values are taken as
+// they are, since the host-specific variables would describe this host.
+func (r *Registry) AdvertiseRemoteService(
+	addrPort netip.AddrPort, name string, labels map[string]string, opts ...ServiceOption,
+) error {
+	if err := checkRemoteAddr(addrPort, r.status); err != nil {
+		return err
+	}
+	return r.addService(addrPort, tcpTarget(addrPort), name, labels, opts)
 }
 
-// serviceMatches implements the matching logic for FindService.
-func serviceMatches(s Service, name string, labels map[string]string) bool {
-	if s.Name != name {
-		return false
+// checkRemoteAddr verifies that addrPort can be advertised as a remote service
+// on the Tailnet that status describes.
+func checkRemoteAddr(addrPort netip.AddrPort, status StatusProvider) error {
+	if !addrPort.Addr().Is4() {
+		return fmt.Errorf("Non-IPv4 address %s", addrPort.String())
 	}
-	for k, v := range labels {
-		sv, ok := s.Labels[k]
-		if !ok || v != sv {
-			return false
-		}
+	if p, ok := status.(AnyAddrProvider); ok && p.AllowAnyAddr() {
+		return nil
 	}
-	return true
+	if prefix, err := addrPort.Addr().Prefix(8); err != nil {
+		panic(err) // Only happens on bad params
+	} else if prefix != netip.MustParsePrefix("100.0.0.0/8") {
+		return fmt.Errorf("Non-tailscale address %s", addrPort.String())
+	}
+	return nil
 }
 
-// Local Registry API //////////////////////////////////////////////////////////
+// AdvertiseRemoteServiceHost is like AdvertiseRemoteService, but takes a
+// "host:port" string. The host can be an IP address or the MagicDNS name of a
+// Tailnet node (either "printer" or "printer.tailnet.ts.net"), which gets
+// resolved to the node's Tailnet address via the Tailscale status.
+func (r *Registry) AdvertiseRemoteServiceHost(
+	hostPort string, name string, labels map[string]string, opts ...ServiceOption,
+) error {
+	ap, err := resolveRemoteAddr(hostPort, r.status)
+	if err != nil {
+		return err
+	}
+	return r.addService(ap, tcpTarget(ap), name, labels, opts)
+}
 
-// Registry is the local interface to the Minidisc service discovery. It
-// maintains and advertises a list of services that the current process offers.
-type Registry struct {
-	http.Handler
+// ResolveRemoteAddr parses and validates the address of a remote service the
+// same way AdvertiseRemoteServiceHost does, without advertising anything.
+func ResolveRemoteAddr(hostPort string) (netip.AddrPort, error) {
+	return resolveRemoteAddr(hostPort, currentStatusProvider())
+}
 
-	mutex sync.Mutex
-	// The local Tailnet IPv4 address of the local host. We set this at init
-	// time to be robust against host's admin switching to a different Tailnet.
-	localAddr     netip.Addr
-	localServices []Service
-	delegates     []netip.AddrPort
+// resolveRemoteAddr implements ResolveRemoteAddr with a given status provider.
+func resolveRemoteAddr(hostPort string, status StatusProvider) (netip.AddrPort, error) {
+	ap, err := resolveHostPort(hostPort, status)
+	if err != nil {
+		return ap, err
+	}
+	return ap, checkRemoteAddr(ap, status)
 }
 
-// StartRegistry creates a local Minidisc registry and starts the goroutines
-// that keep it up-to-date and connected to other registries on the Tailnet.
-func StartRegistry() (*Registry, error) {
+// LookupHostname returns the fully-qualified MagicDNS name of the Tailnet node
+// with address addr, e.g. to verify TLS certificates issued for that name.
+func LookupHostname(addr netip.Addr) (string, error) {
 	tmap, err := getTailnetMap()
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("%w: %v", ErrTailnetUnavailable, err)
 	}
-	r := &Registry{
-		localAddr:     tmap.LocalAddr,
-		localServices: []Service{}, // Empty list, but JSON marshal-able.
+	if name, ok := tmap.lookupAddr(addr); ok {
+		return name, nil
 	}
-	logger.Infof("Starting Minidisc registry")
-	go r.connect()
-	return r, nil
+	return "", fmt.Errorf("No Tailnet node with address %s", addr)
 }
 
-// AdvertiseService adds a local service to the list this registry advertises.
-func (r *Registry) AdvertiseService(port uint16, name string, labels map[string]string) error {
-	ap := netip.AddrPortFrom(r.localAddr, port)
-	return r.addService(ap, name, labels)
+// resolveHostPort parses a "host:port" string, resolving host via MagicDNS if
+// it isn't an IP address.
+func resolveHostPort(hostPort string, status StatusProvider) (netip.AddrPort, error) {
+	if ap, err := netip.ParseAddrPort(hostPort); err == nil {
+		return ap, nil
+	}
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("Bad port in address %s", hostPort)
+	}
+	tmap, err := status.TailnetMap()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr, ok := tmap.resolveHost(host)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("Cannot resolve host %s on the Tailnet", host)
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), nil
 }
 
-// AdvertiseRemoteService adds a remote service to the list this registry
-// advertises. You should only do this to include services that aren't minidisc
-// enabled themselves.
-func (r *Registry) AdvertiseRemoteService(
-	addrPort netip.AddrPort, name string, labels map[string]string,
+// AdvertiseUnixService adds a service listening on a Unix domain socket to the
+// list this registry advertises. Its AddrPort is the zero value, so clients
+// need to use Service.UnixSocketPath; FindService can't return it. Clients
+// that predate protocol version 2 don't see it at all.
+func (r *Registry) AdvertiseUnixService(
+	socketPath, name string, labels map[string]string, opts ...ServiceOption,
 ) error {
-	if prefix, err := addrPort.Addr().Prefix(8); err != nil {
-		panic(err) // Only happens on bad params
-	} else if prefix != netip.MustParsePrefix("100.0.0.0/8") {
-		return fmt.Errorf("Non-tailscale address %s", addrPort.String())
+	if !filepath.IsAbs(socketPath) {
+		return fmt.Errorf("Socket path %s is not absolute", socketPath)
 	}
-	return r.addService(addrPort, name, labels)
+	return r.addService(netip.AddrPort{}, unixScheme+socketPath, name, labels, opts)
+}
+
+// isRemote returns whether a service at addrPort runs on another host, so the
+// host-specific label variables don't apply to it. Unix services are local.
+func (r *Registry) isRemote(addrPort netip.AddrPort) bool {
+	return addrPort.IsValid() && addrPort.Addr() != r.localAddr
 }
 
 // addService implements the common parts of AdvertiseService and AdvertiseRemoteService.
 func (r *Registry) addService(
-	addrPort netip.AddrPort, name string, labels map[string]string,
+	addrPort netip.AddrPort,
+	target, name string,
+	labels map[string]string,
+	opts []ServiceOption,
 ) error {
+	if !r.isRemote(addrPort) {
+		var err error
+		if labels, err = r.expandLabels(labels); err != nil {
+			return err
+		}
+	}
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	for _, ls := range r.localServices {
-		if addrPort == ls.AddrPort {
-			return fmt.Errorf("Address %s already registered", addrPort.String())
+		if target == ls.Target {
+			return fmt.Errorf("Address %s already registered", target)
 		}
 	}
-	if labels == nil {
-		labels = make(map[string]string)
-	}
-	r.localServices = append(r.localServices, Service{
+	s := Service{
 		Name:     name,
 		Labels:   labels,
 		AddrPort: addrPort,
-	})
+		Target:   target,
+		// UTC without monotonic reading, so it survives a JSON round trip.
+		RegisteredAt: time.Now().UTC(),
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	s = NormalizeService(s)
+	r.localServices = append(r.localServices, s)
+	r.events.publish(EventServiceAdded, s)
 	logger.Infof(
 		"Advertising new service. Name: %s, labels: %v, address: %s",
-		name, labels, addrPort.String(),
+		name, labels, target,
 	)
 	return nil
 }
 
+// LocalServices returns the services advertised through this registry, not
+// including those of its delegates.
+func (r *Registry) LocalServices() []Service {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return slices.Clone(r.localServices)
+}
+
 // UnlistService removes a local service from the list this registry advertises.
 func (r *Registry) UnlistService(port uint16) error {
+	if !r.unlist(func(s Service) bool {
+		return s.AddrPort.IsValid() && port == s.AddrPort.Port()
+	}) {
+		return fmt.Errorf("No service at port %d", port)
+	}
+	return nil
+}
+
+// UnlistUnixService removes a service added with AdvertiseUnixService.
+func (r *Registry) UnlistUnixService(socketPath string) error {
+	if !r.unlist(func(s Service) bool { return s.Target == unixScheme+socketPath }) {
+		return fmt.Errorf("No service at socket %s", socketPath)
+	}
+	return nil
+}
+
+// UnlistServiceByName removes all local services named name, whatever their
+// address, from the list this registry advertises.
+func (r *Registry) UnlistServiceByName(name string) error {
+	if !r.unlist(func(s Service) bool { return s.Name == name }) {
+		return fmt.Errorf("No service named %s", name)
+	}
+	return nil
+}
+
+// UnlistServiceAt removes the local or remote service advertised at addrPort
+// from the list this registry advertises.
+func (r *Registry) UnlistServiceAt(addrPort netip.AddrPort) error {
+	if !r.unlist(func(s Service) bool { return s.AddrPort == addrPort }) {
+		return fmt.Errorf("No service at %s", addrPort)
+	}
+	return nil
+}
+
+// unlist removes the local services that match, and returns whether there
+// were any.
+func (r *Registry) unlist(match func(Service) bool) bool {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	oldLen := len(r.localServices)
 	r.localServices = slices.DeleteFunc(r.localServices, func(s Service) bool {
-		return port == s.AddrPort.Port()
+		if match(s) {
+			r.events.publish(EventServiceRemoved, s)
+			return true
+		}
+		return false
 	})
-	if len(r.localServices) == oldLen {
-		return fmt.Errorf("No service at port %d", port)
+	return len(r.localServices) != oldLen
+}
+
+// UpdateServiceLabels replaces the labels of all local services named name,
+// without unlisting them in between. Their RegisteredAt time stays the same.
+func (r *Registry) UpdateServiceLabels(name string, labels map[string]string) error {
+	if found, err := r.updateLabels(func(s Service) bool { return s.Name == name }, labels); err != nil {
+		return err
+	} else if !found {
+		return fmt.Errorf("No service named %s", name)
+	}
+	logger.Infof("Updated labels of service %s to %v", name, labels)
+	return nil
+}
+
+// UpdateServiceLabelsAt is like UpdateServiceLabels, but only updates the
+// local or remote service advertised at addrPort.
+func (r *Registry) UpdateServiceLabelsAt(addrPort netip.AddrPort, labels map[string]string) error {
+	if found, err := r.updateLabels(func(s Service) bool { return s.AddrPort == addrPort }, labels); err != nil {
+		return err
+	} else if !found {
+		return fmt.Errorf("No service at %s", addrPort)
+	}
+	logger.Infof("Updated labels of service at %s to %v", addrPort, labels)
+	return nil
+}
+
+// updateLabels replaces the labels of the local services that match, and
+// returns whether there were any. As in addService, labels are only expanded
+// for services on this host.
+func (r *Registry) updateLabels(match func(Service) bool, labels map[string]string) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	expanded := labels
+	if slices.ContainsFunc(r.localServices, func(s Service) bool {
+		return match(s) && !r.isRemote(s.AddrPort)
+	}) {
+		var err error
+		if expanded, err = r.expandLabels(labels); err != nil {
+			return false, err
+		}
+	}
+	found := false
+	for i, s := range r.localServices {
+		if !match(s) {
+			continue
+		}
+		found = true
+		// Copy the service, as LocalServices shares the labels map.
+		if r.isRemote(s.AddrPort) {
+			s.Labels = maps.Clone(labels)
+		} else {
+			s.Labels = maps.Clone(expanded)
+		}
+		r.localServices[i] = NormalizeService(s)
+		r.events.publish(EventServiceUpdated, r.localServices[i])
+	}
+	return found, nil
+}
+
+// AddUpstream makes the registry include the services of the registry at addr,
+// usually on another host, when it's queried. This allows building a tree of
+// aggregators on large Tailnets, so clients only need to query its root with
+// ListServicesFrom.
+func (r *Registry) AddUpstream(addr netip.AddrPort) error {
+	if !addr.IsValid() {
+		return fmt.Errorf("Invalid upstream address %s", addr)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if addr == r.addr {
+		return fmt.Errorf("Registry can't be its own upstream")
+	}
+	if !slices.Contains(r.upstreams, addr) {
+		r.upstreams = append(r.upstreams, addr)
 	}
 	return nil
 }
@@ -211,105 +1805,513 @@ func (r *Registry) UnlistService(port uint16) error {
 
 // ServeHTTP provides the HTTP handlers that other Minidisc registries talk to.
 func (r *Registry) ServeHTTP(wrt http.ResponseWriter, req *http.Request) {
+	if r.accessLog != nil {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: wrt}
+		wrt = sw
+		defer func() { r.accessLog(req, sw.status(), time.Since(start)) }()
+	}
+	if !r.isAllowed(req) {
+		wrt.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	if !r.isAuthorized(req) {
+		wrt.Header().Set("WWW-Authenticate", `Bearer realm="minidisc"`)
+		wrt.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 	if req.URL.Path == "/services" {
 		r.handleGetServices(wrt, req)
 	} else if req.URL.Path == "/add-delegate" {
 		r.handlePostAddDelegate(wrt, req)
+	} else if req.URL.Path == "/remove-delegate" {
+		r.handlePostRemoveDelegate(wrt, req)
 	} else if req.URL.Path == "/ping" {
 		r.handleGetPing(wrt, req)
+	} else if req.URL.Path == "/status" {
+		r.handleGetStatus(wrt, req)
+	} else if req.URL.Path == "/events" {
+		r.handleGetEvents(wrt, req)
 	} else {
 		http.NotFound(wrt, req)
 	}
 }
 
-// handleGetServices handles "GET /services".
+// statusWriter remembers the status of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Unwrap gives http.ResponseController access to the original writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// status returns the response status, which is 200 if the handler didn't
+// write anything.
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+// isAllowed checks the request against the rate limit for its remote address.
+// Pings are exempt, so the watchdog keeps working under load, and so is the
+// local host, since a leader queries its delegates on behalf of many clients.
+func (r *Registry) isAllowed(req *http.Request) bool {
+	if r.limiter == nil || req.URL.Path == "/ping" {
+		return true
+	}
+	remote, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil || remote.Addr().Unmap() == r.localAddr {
+		return true
+	}
+	if !r.limiter.allow(remote.Addr().Unmap(), time.Now()) {
+		logger.Debugf("Rate limit exceeded for %s", remote.Addr())
+		return false
+	}
+	return true
+}
+
+// isLocalRequest returns whether the request comes from this host: from the
+// local Tailnet address, or from the loopback address, which is the source of
+// connections to a local address in 127.0.0.0/8, e.g. with a static Tailnet.
+func (r *Registry) isLocalRequest(req *http.Request) bool {
+	remote, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := remote.Addr().Unmap()
+	return addr == r.localAddr || addr == netip.IPv6Loopback() ||
+		addr == netip.AddrFrom4([4]byte{127, 0, 0, 1})
+}
+
+// isAuthorized checks the request's bearer token against the registry's auth
+// token. Without a configured token, all requests are authorized.
+func (r *Registry) isAuthorized(req *http.Request) bool {
+	if r.authToken == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(r.authToken)) == 1
+}
+
+// handleGetServices handles "GET /services". With "?local=true", it only lists
+// this registry's own services, skipping those of its delegates and upstreams.
 func (r *Registry) handleGetServices(wrt http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
 		wrt.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Grab local data first.
+	// Grab local data first, stamped with our address as the source.
 	r.mutex.Lock()
-	services := r.localServices
-	delegates := r.delegates
+	services := slices.Clone(r.localServices)
+	// Copy, as removeDelegate modifies the slice in place.
+	delegates := slices.Clone(r.delegates)
+	upstreams := r.upstreams
+	self := r.addr
+	for i := range services {
+		services[i].Source = r.addr
+	}
 	r.mutex.Unlock()
+	if local, _ := strconv.ParseBool(req.URL.Query().Get("local")); local {
+		delegates, upstreams = nil, nil
+	}
+	// If the request already passed through us, upstreams form a cycle. Abort
+	// it, the registry that sent the request already has our services.
+	path := parsePath(req.Header.Get(pathHeader))
+	if slices.Contains(path, self) {
+		logger.Warnf("Aggregation loop: %s -> %s", formatPath(path), self)
+		wrt.WriteHeader(http.StatusLoopDetected)
+		return
+	}
+	ctx := context.WithValue(req.Context(), pathKey{}, append(path, self))
+	ctx = GetTracer().Extract(ctx, req.Header)
+	ctx, span := GetTracer().Start(ctx, "minidisc.handleGetServices")
+	defer span.End()
 
 	// Query delegates sequentially. This assumes that delegates are rare, so
 	// querying them in parallel would be unnecessary complexity.
 	for _, ap := range delegates {
-		if part, err := getRemoteServices(ap); err == nil {
-			services = slices.Concat(services, part)
+		if part, err := getRemoteServices(ctx, ap, r.authToken, r.queryTimeout); err == nil {
+			services = slices.Concat(services, withDefaultSource(part, ap))
 		} else if isUrlError(err) {
 			// Errors indicate that the delegate has gone away. Remove it.
 			r.removeDelegate(ap)
 		}
 	}
+	// Same for upstreams, which are just as rare. They're configured
+	// explicitly, so we keep them even if they don't respond.
+	for _, ap := range upstreams {
+		if part, err := getRemoteServices(ctx, ap, r.authToken, r.queryTimeout); err == nil {
+			services = slices.Concat(services, withDefaultSource(part, ap))
+		} else {
+			logger.Warnf("Error fetching services from upstream %s: %v", ap, err)
+		}
+	}
+	span.SetAttribute("minidisc.service_count", len(services))
 
-	// Encode results and send them back.
+	// Encode results and send them back, unless the client already has them.
+	version := negotiateVersion(req.Header)
+	data, err := encodeServices(services, version)
+	if err != nil {
+		logger.Errorf("Error generating JSON: %v", err)
+		wrt.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+	wrt.Header().Set("ETag", etag)
+	wrt.Header().Set(versionHeader, strconv.Itoa(version))
+	wrt.Header().Set(nonceHeader, r.nonce)
+	if req.Header.Get("If-None-Match") == etag {
+		wrt.WriteHeader(http.StatusNotModified)
+		return
+	}
 	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
-	if data, err := json.Marshal(services); err == nil {
+	wrt.Header().Set("Vary", "Accept-Encoding")
+	if !acceptsGzip(req) {
 		wrt.WriteHeader(http.StatusOK)
 		wrt.Write(data)
-	} else {
-		logger.Errorf("Error generating JSON: %v", err)
-		wrt.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	wrt.Header().Set("Content-Encoding", "gzip")
+	wrt.WriteHeader(http.StatusOK)
+	gz := gzip.NewWriter(wrt)
+	gz.Write(data)
+	gz.Close()
+}
+
+// pathHeader lists the registries a services request passed through, separated
+// by commas, so aggregation loops can be detected.
+const pathHeader = "X-Minidisc-Path"
+
+// pathKey is the context key for the path of the request being served, which
+// getRemoteServices passes on in pathHeader.
+type pathKey struct{}
+
+// parsePath parses the value of pathHeader, skipping malformed entries.
+func parsePath(header string) []netip.AddrPort {
+	var path []netip.AddrPort
+	for _, part := range strings.Split(header, ",") {
+		if ap, err := netip.ParseAddrPort(strings.TrimSpace(part)); err == nil {
+			path = append(path, ap)
+		}
+	}
+	return path
+}
+
+// formatPath formats path as value for pathHeader.
+func formatPath(path []netip.AddrPort) string {
+	parts := make([]string, len(path))
+	for i, ap := range path {
+		parts[i] = ap.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// acceptsGzip returns whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(coding) == "gzip" && strings.TrimSpace(params) != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRequestSize is the largest request body the registry accepts. Requests
+// are tiny, so anything bigger is bogus.
+const maxRequestSize = 64 << 10
+
+// bodyErrorStatus returns the response status for an error reading a request
+// body.
+func bodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+type addDelegateRequest struct {
+	AddrPort netip.AddrPort `json:"addrPort"`
+}
+
+// handlePostAddDelegate handles "POST /add-delegate".
+func (r *Registry) handlePostAddDelegate(wrt http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		wrt.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(wrt, req.Body, maxRequestSize))
+	if err != nil {
+		logger.Warnf("Error reading POST body: %v", err)
+		wrt.WriteHeader(bodyErrorStatus(err))
+		return
+	}
+	adr := &addDelegateRequest{}
+	if err := json.Unmarshal(body, adr); err != nil {
+		logger.Warnf("Malformed request: %v", err)
+		wrt.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := r.validateDelegate(adr.AddrPort); err != nil {
+		logger.Warnf("Rejecting add-delegate request: %v", err)
+		wrt.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := r.addDelegate(adr.AddrPort); err != nil {
+		logger.Warnf("Cannot add delegate at %s: %v", adr.AddrPort, err)
+		wrt.WriteHeader(http.StatusServiceUnavailable)
+		return
 	}
+	logger.Infof("Added delegate at %s", adr.AddrPort)
+	wrt.WriteHeader(http.StatusOK)
 }
 
-type addDelegateRequest struct {
-	AddrPort netip.AddrPort `json:"addrPort"`
-}
-
-// handlePostAddDelegate handles "POST /add-delegate".
-func (r *Registry) handlePostAddDelegate(wrt http.ResponseWriter, req *http.Request) {
+// handlePostRemoveDelegate handles "POST /remove-delegate", which delegates
+// send when they shut down. It takes the same request as add-delegate, and
+// only accepts it from the local host.
+func (r *Registry) handlePostRemoveDelegate(wrt http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
 		wrt.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	body, err := io.ReadAll(req.Body)
+	body, err := io.ReadAll(http.MaxBytesReader(wrt, req.Body, maxRequestSize))
 	if err != nil {
 		logger.Warnf("Error reading POST body: %v", err)
-		wrt.WriteHeader(http.StatusInternalServerError)
+		wrt.WriteHeader(bodyErrorStatus(err))
 		return
 	}
-	adr := &addDelegateRequest{}
-	if err := json.Unmarshal(body, adr); err != nil {
+	rdr := &addDelegateRequest{}
+	if err := json.Unmarshal(body, rdr); err != nil {
 		logger.Warnf("Malformed request: %v", err)
 		wrt.WriteHeader(http.StatusBadRequest)
+		return
 	}
-	if adr.AddrPort.Addr() != r.localAddr {
-		logger.Warnf("add-delegate request for non-local address %s\n", adr.AddrPort.String())
+	// Delegates run on this host, so anyone else could only use this to
+	// deregister a live delegate.
+	if !r.isLocalRequest(req) || rdr.AddrPort.Addr() != r.localAddr {
+		logger.Warnf("Rejecting remove-delegate request for %s from %s", rdr.AddrPort, req.RemoteAddr)
 		wrt.WriteHeader(http.StatusForbidden)
 		return
 	}
+	r.removeDelegate(rdr.AddrPort)
+	logger.Infof("Removed delegate at %s", rdr.AddrPort)
 	wrt.WriteHeader(http.StatusOK)
+}
+
+// validateDelegate checks that a delegate address can plausibly belong to a
+// registry on this host: delegates bind to an OS-assigned port on the local
+// Tailnet address, so anything else is either a bug or a spoofing attempt.
+// Delegates configured with a port range are the exception, as long as it's
+// our range, too.
+func (r *Registry) validateDelegate(ap netip.AddrPort) error {
+	if ap.Addr() != r.localAddr {
+		return fmt.Errorf("Non-local delegate address %s", ap.String())
+	}
+	if ap.Port() == r.port {
+		return fmt.Errorf("Delegate on leader port %d", ap.Port())
+	}
+	minPort, maxPort := ephemeralPortRange()
+	if ap.Port() >= minPort && ap.Port() <= maxPort {
+		return nil
+	}
+	first, last := r.delegatePortRange[0], r.delegatePortRange[1]
+	if first != 0 && ap.Port() >= first && ap.Port() <= last {
+		return nil
+	}
+	return fmt.Errorf(
+		"Delegate port %d outside of ephemeral range %d-%d and delegate port range",
+		ap.Port(), minPort, maxPort,
+	)
+}
+
+// ephemeralPortRange returns the range of ports the OS assigns when binding to
+// port 0. On Linux, this is read from procfs, elsewhere it's the IANA range.
+func ephemeralPortRange() (uint16, uint16) {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+	if err != nil {
+		return 49152, 65535
+	}
+	var minPort, maxPort uint16
+	if _, err := fmt.Sscan(string(data), &minPort, &maxPort); err != nil {
+		return 49152, 65535
+	}
+	return minPort, maxPort
+}
+
+// errDelegatesFull is returned by addDelegate if the registry already has the
+// maximum number of live delegates.
+var errDelegatesFull = errors.New("Too many delegates")
 
-	logger.Infof("Adding delegate at %s", adr.AddrPort)
-	r.addDelegate(adr.AddrPort)
+// addDelegate adds d to the list of delegates. If that list is full, it first
+// tries to make room by pruning delegates that no longer respond to pings.
+func (r *Registry) addDelegate(d netip.AddrPort) error {
+	if r.tryAddDelegate(d) {
+		return nil
+	}
+	r.pruneDelegates()
+	if r.tryAddDelegate(d) {
+		return nil
+	}
+	return errDelegatesFull
 }
 
-func (r *Registry) addDelegate(d netip.AddrPort) {
+// tryAddDelegate adds d to the list of delegates unless that list is full. It
+// returns whether d is on the list afterwards.
+func (r *Registry) tryAddDelegate(d netip.AddrPort) bool {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	for _, ap := range r.delegates {
 		if ap == d {
-			return // Silently accept double registrations.
+			return true // Silently accept double registrations.
 		}
 	}
+	if len(r.delegates) >= r.maxDelegates {
+		return false
+	}
 	r.delegates = append(r.delegates, d)
+	ctx, cancel := context.WithCancel(context.Background())
+	if r.forwards == nil {
+		r.forwards = make(map[netip.AddrPort]context.CancelFunc)
+	}
+	r.forwards[d] = cancel
+	go func() {
+		select {
+		case <-r.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	go r.forwardEvents(ctx, d)
+	return true
+}
+
+// pruneDelegates pings all delegates and removes those that don't respond.
+func (r *Registry) pruneDelegates() {
+	r.mutex.Lock()
+	delegates := slices.Clone(r.delegates)
+	r.mutex.Unlock()
+	for _, ap := range delegates {
+		if !r.ping(ap) {
+			logger.Infof("Pruning unresponsive delegate at %s", ap)
+			r.removeDelegate(ap)
+		}
+	}
 }
 
 func (r *Registry) removeDelegate(d netip.AddrPort) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	oldLen := len(r.delegates)
 	r.delegates = slices.DeleteFunc(r.delegates, func(ap netip.AddrPort) bool {
 		return ap == d
 	})
+	if len(r.delegates) != oldLen {
+		r.events.publish(EventDelegateRemoved, addDelegateRequest{AddrPort: d})
+	}
+	if cancel, ok := r.forwards[d]; ok {
+		cancel()
+		delete(r.forwards, d)
+	}
 }
 
+// handleGetPing handles "GET /ping". The response identifies us as a Minidisc
+// registry with a version header. Delegates pass their own address in another
+// header, and the response tells them their rank among the leader's delegates
+// (0 for the oldest), which decides the order in which they try to take over
+// once the leader dies.
 func (r *Registry) handleGetPing(wrt http.ResponseWriter, req *http.Request) {
+	wrt.Header().Set(versionHeader, strconv.Itoa(ProtocolVersion))
+	wrt.Header().Set(nonceHeader, r.nonce)
+	if d, err := netip.ParseAddrPort(req.Header.Get(delegateHeader)); err == nil {
+		r.mutex.Lock()
+		rank := slices.Index(r.delegates, d)
+		r.mutex.Unlock()
+		if rank >= 0 {
+			wrt.Header().Set(rankHeader, strconv.Itoa(rank))
+		}
+	}
+	wrt.WriteHeader(http.StatusOK)
+}
+
+const (
+	delegateHeader = "X-Minidisc-Delegate"
+	rankHeader     = "X-Minidisc-Rank"
+	// nonceHeader carries a registry's startup nonce on /ping and /services.
+	// A different value at the same address means the registry was restarted
+	// and lost its state, e.g. its delegates.
+	nonceHeader = "X-Minidisc-Nonce"
+)
+
+// RegistryStatus is the response of "GET /status", describing the state of a
+// registry for debugging.
+type RegistryStatus struct {
+	Role          string           `json:"role"`
+	Nonce         string           `json:"nonce"`
+	LocalAddr     netip.Addr       `json:"localAddr"`
+	Addr          netip.AddrPort   `json:"addr"`
+	Delegates     []netip.AddrPort `json:"delegates"`
+	Upstreams     []netip.AddrPort `json:"upstreams,omitempty"`
+	ServiceCount  int              `json:"serviceCount"`
+	Services      []Service        `json:"services"`
+	UptimeSeconds float64          `json:"uptimeSeconds"`
+}
+
+// handleGetStatus handles "GET /status".
+func (r *Registry) handleGetStatus(wrt http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		wrt.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	services := r.LocalServices()
+	r.mutex.Lock()
+	status := RegistryStatus{
+		Role:          r.role.String(),
+		Nonce:         r.nonce,
+		LocalAddr:     r.localAddr,
+		Addr:          r.addr,
+		Delegates:     slices.Clone(r.delegates),
+		Upstreams:     slices.Clone(r.upstreams),
+		ServiceCount:  len(services),
+		Services:      services,
+		UptimeSeconds: time.Since(r.startTime).Seconds(),
+	}
+	r.mutex.Unlock()
+	if status.Delegates == nil {
+		status.Delegates = []netip.AddrPort{} // JSON marshal-able.
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		logger.Errorf("Error generating JSON: %v", err)
+		wrt.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
 	wrt.WriteHeader(http.StatusOK)
+	wrt.Write(data)
 }
 
 // Minidisc peer-to-peer node management ///////////////////////////////////////
@@ -328,29 +2330,233 @@ func (r *Registry) handleGetPing(wrt http.ResponseWriter, req *http.Request) {
 //     away. If that happens, restart the process to try and become the leader
 //     this time.
 //
-// If port 28004 is already taken by an unrelated server, give up and die.
+// When the leader dies, its delegates don't all race for port 28004 at once.
+// Instead, each waits according to its rank in the leader's delegate list, so
+// the oldest delegate deterministically becomes the new leader, and the others
+// find it in place when they reconnect.
+//
+// If port 28004 is taken by an unrelated server when the registry starts,
+// StartRegistry fails. If that happens later on, keep retrying in case the
+// server goes away.
+//
+// If StartRegistryOptions.Port is set, all of the above uses that port instead
+// of 28004.
+//
+// connect returns once the registry is closed.
 func (r *Registry) connect() {
-	mainAddr := fmt.Sprintf("%s:28004", r.localAddr.String())
-	delegateAddr := fmt.Sprintf("%s:0", r.localAddr.String())
-	for {
+	defer close(r.done)
+	mainAddr := r.leaderAddr().String()
+	for !r.isClosed() {
 		if listener, err := net.Listen("tcp4", mainAddr); err == nil {
 			r.runLeaderNode(listener)
-		} else if listener, err := net.Listen("tcp4", delegateAddr); err == nil {
-			if err := r.runDelegateNode(listener); err != nil {
+			r.setRole(RoleConnecting)
+		} else if listener, err := r.listenDelegate(); err == nil {
+			err := r.runDelegateNode(listener)
+			r.setRole(RoleConnecting)
+			var delay time.Duration
+			if err != nil {
+				if errors.Is(err, errForeignLeader) && !r.isReady() {
+					r.startErr = err
+					r.markReady()
+					return
+				}
+				r.markReady() // Don't block StartRegistry during the retry.
 				logger.Infof("Waiting 10s before restarting registry")
-				time.Sleep(10 * time.Second)
+				delay = 10 * time.Second
+			} else {
+				r.mutex.Lock()
+				delay = time.Duration(r.rank)*promotionStagger + jitter(promotionStagger/2)
+				r.mutex.Unlock()
 			}
+			select {
+			case <-r.stop:
+			case <-time.After(delay):
+			}
+		} else if !r.isReady() {
+			r.startErr = fmt.Errorf("Couldn't bind to any port: %w", err)
+			r.markReady()
+			return
 		} else {
-			log.Fatalf("Couldn't bind to any port: %v", err)
+			logger.Errorf("Couldn't bind to any port, retrying in 10s: %v", err)
+			select {
+			case <-r.stop:
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}
+}
+
+// listenDelegate binds to the first free port in the delegate port range, if
+// there is one, or else to a port assigned by the OS.
+func (r *Registry) listenDelegate() (net.Listener, error) {
+	if first, last := r.delegatePortRange[0], r.delegatePortRange[1]; first != 0 {
+		for port := int(first); port <= int(last); port++ {
+			ap := netip.AddrPortFrom(r.localAddr, uint16(port))
+			if listener, err := net.Listen("tcp4", ap.String()); err == nil {
+				return listener, nil
+			}
+		}
+		if r.strictDelegatePorts {
+			return nil, fmt.Errorf("All delegate ports %d-%d are taken", first, last)
 		}
+		logger.Warnf("All delegate ports %d-%d are taken, using any port", first, last)
+	}
+	return net.Listen("tcp4", netip.AddrPortFrom(r.localAddr, 0).String())
+}
+
+// ErrRegistryClosed is returned when closing a registry a second time.
+var ErrRegistryClosed = errors.New("Registry is already closed")
+
+// Close stops the registry. It shuts down its HTTP server, which releases its
+// port and stops advertising its services, and waits for its background
+// goroutines to exit. A delegate also removes itself from the leader.
+func (r *Registry) Close() error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return ErrRegistryClosed
+	}
+	r.closed = true
+	close(r.stop)
+	r.mutex.Unlock()
+	registriesMutex.Lock()
+	delete(registries, r)
+	registriesMutex.Unlock()
+	<-r.done
+	r.closeDNS()
+	logger.Infof("Minidisc registry closed")
+	return nil
+}
+
+// HealthCheck returns nil if the registry can read the Tailnet status and is
+// serving on its address, or else an error saying what's wrong. While the
+// registry reconnects, e.g. after its leader went away, it's unhealthy.
+func (r *Registry) HealthCheck(ctx context.Context) error {
+	if r.isClosed() {
+		return ErrRegistryClosed
+	}
+	if _, err := r.status.TailnetMap(); err != nil {
+		return fmt.Errorf("%w: %v", ErrTailnetUnavailable, err)
+	}
+	if r.Role() == RoleConnecting {
+		return fmt.Errorf("Registry is reconnecting")
+	}
+	if _, err := pingContext(ctx, r.Addr(), r.authToken); err != nil {
+		return fmt.Errorf("Registry isn't serving: %v", err)
+	}
+	return nil
+}
+
+// closeDNS stops the DNS server, if it's running.
+func (r *Registry) closeDNS() {
+	if r.dnsConn != nil {
+		r.dnsConn.Close()
+	}
+}
+
+// isClosed returns whether Close has been called.
+func (r *Registry) isClosed() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// promotionStagger is how much longer each delegate waits than the previous
+// one before trying to become the leader.
+const promotionStagger = 250 * time.Millisecond
+
+// jitter returns a random duration in [0, d). It's added to timers so that
+// registries which started together don't keep acting in lockstep. To keep the
+// promotion order by rank, it must stay below promotionStagger there.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d)
+}
+
+// setAddr records the address of the listener the registry serves on.
+func (r *Registry) setAddr(listener net.Listener) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.addr = netip.MustParseAddrPort(listener.Addr().String())
+}
+
+// markReady unblocks StartRegistry. It's safe to call repeatedly.
+func (r *Registry) markReady() {
+	r.readyOnce.Do(func() { close(r.ready) })
+}
+
+// isReady returns whether markReady has been called.
+func (r *Registry) isReady() bool {
+	select {
+	case <-r.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// Limits for the registry's HTTP server, so that slow or misbehaving clients
+// can't tie up connections indefinitely. Responses may take a while, since the
+// leader queries its delegates while handling a request.
+const (
+	serverReadHeaderTimeout = 5 * time.Second
+	serverReadTimeout       = 10 * time.Second
+	serverWriteTimeout      = 30 * time.Second
+	serverIdleTimeout       = 2 * time.Minute
+	serverMaxHeaderBytes    = 64 << 10
+)
+
+// newServer returns an HTTP server for the registry, as leader or delegate.
+func (r *Registry) newServer() *http.Server {
+	shutdown := make(chan struct{})
+	srv := &http.Server{
+		Handler:           r,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+		MaxHeaderBytes:    serverMaxHeaderBytes,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), shutdownKey{}, shutdown)
+		},
 	}
+	srv.RegisterOnShutdown(func() { close(shutdown) })
+	return srv
 }
 
-// runLeaderNode runs the HTTP server in "leader" mode.
+// runLeaderNode runs the HTTP server in "leader" mode. While serving, it
+// regularly prunes delegates that have gone away, so they don't slow down the
+// next service listing.
 func (r *Registry) runLeaderNode(listener net.Listener) {
 	logger.Infof("Minidisc registry started as leader")
-	err := http.Serve(listener, r)
-	logger.Infof("Minidisc leader exited: %v", err)
+	r.setAddr(listener)
+	r.setRole(RoleLeader)
+	r.markReady()
+	srv := r.newServer()
+	exit := make(chan error, 1)
+	go func() {
+		exit <- srv.Serve(listener)
+	}()
+	ticker := time.NewTicker(r.pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-exit:
+			logger.Infof("Minidisc leader exited: %v", err)
+			return
+		case <-ticker.C:
+			r.pruneDelegates()
+		case <-r.stop:
+			srv.Shutdown(context.Background())
+			logger.Infof("Minidisc leader exited: %v", <-exit)
+			return
+		}
+	}
 }
 
 // runDelegateNode runs the HTTP server in "delegate" mode. Because we're not
@@ -359,31 +2565,29 @@ func (r *Registry) runLeaderNode(listener net.Listener) {
 // to detect if the leader goes away. When that happens, we shut down the
 // delegate server and try to restart it as the leader.
 func (r *Registry) runDelegateNode(listener net.Listener) error {
-	logger.Infof("Minidisc registry started as leader")
-	srv := &http.Server{Handler: r}
-	exit := make(chan error)
+	logger.Infof("Minidisc registry started as delegate")
+	r.setAddr(listener)
+	srv := r.newServer()
+	exit := make(chan error, 1)
 	go func() {
 		exit <- srv.Serve(listener)
 	}()
 
-	// Register with leader.
-	mainAddr := fmt.Sprintf("%s:28004", r.localAddr.String())
-	data, err := json.Marshal(&addDelegateRequest{
-		AddrPort: netip.MustParseAddrPort(listener.Addr().String()),
-	})
-	if err != nil {
-		log.Fatalf("Error marshalling JSON: %v", err)
+	defer r.leaderClient.CloseIdleConnections()
+	self := netip.MustParseAddrPort(listener.Addr().String())
+	if err := r.verifyLeader(); err != nil {
+		srv.Close()
+		return err
 	}
-	url := fmt.Sprintf("http://%s/add-delegate", mainAddr)
-	mime := "application/json"
-	resp, err := http.Post(url, mime, bytes.NewReader(data))
-	if err != nil {
-		return fmt.Errorf("Cannot contact leader: %v", err)
-	} else if resp.StatusCode != 200 {
-		return fmt.Errorf("Error registering with leader: %s", resp.Status)
+	if err := r.registerWithLeader(self); err != nil {
+		srv.Close()
+		return err
 	}
+	r.setRole(RoleDelegate)
+	r.markReady()
 
 	// Serve, but regularly check whether the leader has died.
+	stop := r.stop
 	for {
 		select {
 		case err := <-exit:
@@ -394,49 +2598,336 @@ func (r *Registry) runDelegateNode(listener net.Listener) error {
 				logger.Warnf("Minidisc delegate exited with error: %v", err)
 				return err
 			}
-		case <-time.After(5 * time.Second):
-			if !r.leaderIsAlive() {
+		case <-time.After(r.watchdogInterval + jitter(r.watchdogInterval/5)):
+			if !r.leaderIsAlive(self) {
 				logger.Infof("Leader is unreachable. Stopping delegate.")
 				srv.Shutdown(context.Background())
 			}
+		case <-stop:
+			stop = nil // Only shut down once, then wait for exit.
+			if err := r.deregisterFromLeader(self); err != nil {
+				logger.Warnf("Cannot deregister from leader: %v", err)
+			}
+			srv.Shutdown(context.Background())
 		}
 	}
 }
 
+// errForeignLeader means that the registry port is bound by something other
+// than a Minidisc registry.
+var errForeignLeader = errors.New("Registry port is taken by a non-Minidisc server")
+
+// leaderAddr returns the address the leader on this host serves on.
+func (r *Registry) leaderAddr() netip.AddrPort {
+	return netip.AddrPortFrom(r.localAddr, r.port)
+}
+
+// verifyLeader checks that the server on the registry port is a Minidisc
+// registry, so we don't send add-delegate requests to some unrelated service.
+// Current registries identify themselves with a version header on /ping. For
+// older ones, we check that /services returns a valid service list.
+func (r *Registry) verifyLeader() error {
+	leader := r.leaderAddr()
+	url := fmt.Sprintf("http://%s/ping", leader)
+	header, err := r.sendPing(r.leaderClient, url, nil, r.leaderPingTimeout)
+	if isUrlError(err) {
+		return fmt.Errorf("Cannot contact leader: %v", err)
+	} else if err == nil && header.Get(versionHeader) != "" {
+		r.mutex.Lock()
+		r.leaderNonce = header.Get(nonceHeader)
+		r.mutex.Unlock()
+		return nil
+	}
+	if _, err := getRemoteServices(context.Background(), leader, r.authToken, r.queryTimeout); err != nil {
+		logger.Errorf("Server at %s isn't a Minidisc leader: %v", leader, err)
+		return errForeignLeader
+	}
+	return nil
+}
+
+// registerWithLeader sends an add-delegate request for the delegate server at
+// ap to the leader.
+func (r *Registry) registerWithLeader(ap netip.AddrPort) error {
+	if err := r.postDelegateRequest("/add-delegate", ap); err != nil {
+		return fmt.Errorf("Error registering with leader: %v", err)
+	}
+	return nil
+}
+
+// deregisterFromLeader sends a remove-delegate request for the delegate server
+// at ap to the leader. Otherwise, the leader only notices that the delegate is
+// gone once it fails to answer a request.
+func (r *Registry) deregisterFromLeader(ap netip.AddrPort) error {
+	return r.postDelegateRequest("/remove-delegate", ap)
+}
+
+// postDelegateRequest sends an addDelegateRequest for ap to the given path on
+// the leader.
+func (r *Registry) postDelegateRequest(path string, ap netip.AddrPort) error {
+	data, err := json.Marshal(&addDelegateRequest{AddrPort: ap})
+	if err != nil {
+		log.Fatalf("Error marshalling JSON: %v", err)
+	}
+	url := fmt.Sprintf("http://%s%s", r.leaderAddr(), path)
+	ctx, cancel := context.WithTimeout(context.Background(), r.queryTimeout)
+	defer cancel()
+	req, err := newRequest(ctx, "POST", url, r.authToken, bytes.NewReader(data))
+	if err != nil {
+		log.Fatalf("Error constructing http.Request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.leaderClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Cannot contact leader: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Leader returned %s", resp.Status)
+	}
+	return nil
+}
+
 // leaderIsAlive sends a request to the Minidisc leader and returns whether that
-// was successful.
-func (r *Registry) leaderIsAlive() bool {
-	c := http.Client{Timeout: 1 * time.Second}
-	url := fmt.Sprintf("http://%s:28004/ping", r.localAddr.String())
-	_, err := c.Get(url)
+// was successful. As a side effect, it updates the rank of this registry, which
+// is the delegate at self, among the leader's delegates. If the leader was
+// restarted since we registered, which the watchdog can miss if it happens
+// between two pings, we register with the new one.
+func (r *Registry) leaderIsAlive(self netip.AddrPort) bool {
+	url := fmt.Sprintf("http://%s/ping", r.leaderAddr())
+	header, err := r.sendPing(
+		r.leaderClient, url, http.Header{delegateHeader: {self.String()}},
+		r.leaderPingTimeout,
+	)
+	if err != nil {
+		return false
+	}
+	r.mutex.Lock()
+	nonce, oldNonce := header.Get(nonceHeader), r.leaderNonce
+	r.mutex.Unlock()
+	if nonce != "" && nonce != oldNonce {
+		logger.Infof("Leader was restarted. Registering again.")
+		if err := r.registerWithLeader(self); err != nil {
+			logger.Warnf("%v", err)
+			return false
+		}
+		r.mutex.Lock()
+		r.leaderNonce = nonce
+		r.mutex.Unlock()
+		return true
+	}
+	if rank, err := strconv.Atoi(header.Get(rankHeader)); err == nil {
+		r.mutex.Lock()
+		r.rank = rank
+		r.mutex.Unlock()
+	}
+	return true
+}
+
+// delegatePingTimeout is how long the leader waits for delegates to answer
+// liveness checks.
+const delegatePingTimeout = 1 * time.Second
+
+// ping sends a liveness check to the Minidisc registry at ap and returns
+// whether it responded successfully.
+func (r *Registry) ping(ap netip.AddrPort) bool {
+	url := fmt.Sprintf("http://%s/ping", ap.String())
+	_, err := r.sendPing(client, url, nil, delegatePingTimeout)
 	return err == nil
 }
 
+// sendPing sends a GET request to url with additional headers using c, and
+// returns the response headers. Non-OK responses, and no response within
+// timeout, are errors.
+func (r *Registry) sendPing(
+	c *http.Client, url string, header http.Header, timeout time.Duration,
+) (http.Header, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := newRequest(ctx, "GET", url, r.authToken, nil)
+	if err != nil {
+		log.Fatalf("Error constructing http.Request: %v", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.Header, fmt.Errorf("%s from %s", resp.Status, url)
+	}
+	return resp.Header, nil
+}
+
 // Tailscale status detection //////////////////////////////////////////////////
 
-type tailnetMap struct {
+// TailnetMap describes the Tailnet as far as Minidisc is concerned.
+type TailnetMap struct {
+	// LocalAddr is the IPv4 Tailnet address of the local host.
 	LocalAddr netip.Addr
+	// PeerAddrs are the IPv4 Tailnet addresses of all other hosts that are
+	// online.
 	PeerAddrs []netip.Addr
+	// HostAddrs maps lower-case MagicDNS names without trailing dot
+	// (host.tailnet.ts.net) to IPv4 addresses. It contains the local host and
+	// all peers, online or not.
+	HostAddrs map[string]netip.Addr
+	// Tags maps the addresses of the local host and peers to their ACL tags,
+	// e.g. "tag:server". Untagged nodes are missing.
+	Tags map[netip.Addr][]string
+}
+
+// resolveHost looks up the IPv4 Tailnet address for a MagicDNS name. Both the
+// fully-qualified name and the bare host name work.
+func (m TailnetMap) resolveHost(host string) (netip.Addr, bool) {
+	host = dnsKey(host)
+	if addr, ok := m.HostAddrs[host]; ok {
+		return addr, true
+	}
+	for name, addr := range m.HostAddrs {
+		if short, _, _ := strings.Cut(name, "."); short == host {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// lookupAddr is the reverse of resolveHost: it returns the fully-qualified name
+// of the node with address addr.
+func (m TailnetMap) lookupAddr(addr netip.Addr) (string, bool) {
+	for name, a := range m.HostAddrs {
+		if a == addr {
+			return name, true
+		}
+	}
+	return "", false
 }
 
 // listTailnetAddrs detects and returns all live IPv4 addresses on the current
-// tailnet, including the own host's.
-func listTailnetAddrs() ([]netip.Addr, error) {
+// tailnet, including the own host's. Each address is listed once. If tags are
+// given, only peers with at least one of them are included.
+func listTailnetAddrs(tags ...string) ([]netip.Addr, error) {
 	tmap, err := getTailnetMap()
 	if err != nil {
 		return nil, err
 	}
-	addrs := make([]netip.Addr, 0, 1+len(tmap.PeerAddrs))
-	addrs = append(addrs, tmap.LocalAddr)
-	addrs = append(addrs, tmap.PeerAddrs...)
-	return addrs, nil
+	peers := tmap.Peers()
+	if len(tags) > 0 {
+		peers = slices.DeleteFunc(peers, func(addr netip.Addr) bool {
+			return !slices.ContainsFunc(tmap.Tags[addr], func(tag string) bool {
+				return slices.Contains(tags, tag)
+			})
+		})
+	}
+	return append([]netip.Addr{tmap.LocalAddr}, peers...), nil
+}
+
+// Peers returns PeerAddrs without duplicates and without LocalAddr, in case a
+// status provider includes it.
+func (m TailnetMap) Peers() []netip.Addr {
+	var result []netip.Addr
+	for _, addr := range m.PeerAddrs {
+		if addr != m.LocalAddr && !slices.Contains(result, addr) {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
+
+// StatusProvider tells Minidisc about the Tailnet. The default reads the
+// status from tailscaled's socket, see SocketStatusProvider. Other
+// implementations can e.g. use a tsnet.Server or Tailscale's client library,
+// or return fixed addresses in tests. Registries and queries learn about the
+// Tailnet only through it, so a different source of the status doesn't need a
+// different implementation of the registry.
+type StatusProvider interface {
+	TailnetMap() (TailnetMap, error)
+}
+
+// AnyAddrProvider is implemented by StatusProviders whose networks aren't
+// limited to Tailscale addresses, e.g. for local development. Registries using
+// one accept any IPv4 address for remote services if AllowAnyAddr returns true.
+type AnyAddrProvider interface {
+	StatusProvider
+	AllowAnyAddr() bool
+}
+
+var (
+	statusMutex    sync.Mutex
+	statusProvider StatusProvider = SocketStatusProvider{}
+)
+
+// SetStatusProvider replaces where ListServices, FindService, StartRegistry and
+// friends learn about the Tailnet. Nil restores the default.
+func SetStatusProvider(p StatusProvider) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	if p == nil {
+		p = SocketStatusProvider{}
+	}
+	statusProvider = p
+}
+
+// currentStatusProvider returns the provider set with SetStatusProvider.
+func currentStatusProvider() StatusProvider {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	return statusProvider
+}
+
+// getTailnetMap returns the Tailnet map from the current status provider.
+func getTailnetMap() (TailnetMap, error) {
+	return currentStatusProvider().TailnetMap()
+}
+
+// CurrentTailnet returns the Tailnet as ListServices sees it, from the status
+// provider set with SetStatusProvider, e.g. for diagnostics.
+func CurrentTailnet() (TailnetMap, error) {
+	tmap, err := getTailnetMap()
+	if err != nil {
+		return TailnetMap{}, fmt.Errorf("%w: %v", ErrTailnetUnavailable, err)
+	}
+	return tmap, nil
+}
+
+// StaticStatusProvider always returns the same Tailnet map.
+type StaticStatusProvider struct {
+	Map TailnetMap
+}
+
+// TailnetMap returns p.Map.
+func (p StaticStatusProvider) TailnetMap() (TailnetMap, error) {
+	return p.Map, nil
+}
+
+// AllowAnyAddr returns true, as static addresses are usually not Tailscale's.
+func (p StaticStatusProvider) AllowAnyAddr() bool {
+	return true
+}
+
+// SetStaticTailnet makes this process use fixed addresses instead of reading
+// them from Tailscale: registries bind to local, and queries go to local and
+// peers. This is meant for local development and integration tests, e.g. with
+// loopback addresses, and lifts the requirement that remote services have
+// Tailscale addresses. An invalid local address switches back to Tailscale.
+func SetStaticTailnet(local netip.Addr, peers []netip.Addr) {
+	if !local.IsValid() {
+		SetStatusProvider(nil)
+		return
+	}
+	SetStatusProvider(StaticStatusProvider{Map: TailnetMap{
+		LocalAddr: local,
+		PeerAddrs: slices.Clone(peers),
+	}})
 }
 
-// Override for testing.
-var tailnetMapForTesting *tailnetMap = nil
+// DefaultTailscaledSocket is where tailscaled listens for local API requests.
+const DefaultTailscaledSocket = "/var/run/tailscale/tailscaled.sock"
 
-// getTailnetMap reads the Tailnet status from Tailscale's unix domain socket,
-// parses it and returns a map of currently-online IPv4 address on the Tailnet.
+// SocketStatusProvider reads the Tailnet status from tailscaled's local API
+// socket.
 //
 // Why not just use Tailscale's own library for this, I hear you ask. Indeed,
 // the first version of this code did use that library (namely the ipnstate.Status
@@ -446,16 +2937,24 @@ var tailnetMapForTesting *tailnetMap = nil
 // that library for other reasons. In contrast, this internal socket interface
 // is much more stable across versions, and we can even do away with the
 // dependency on the Tailscale code.
-func getTailnetMap() (tailnetMap, error) {
-	if tailnetMapForTesting != nil {
-		return *tailnetMapForTesting, nil
+type SocketStatusProvider struct {
+	// Path of the socket. Empty means DefaultTailscaledSocket.
+	Path string
+}
+
+// TailnetMap queries tailscaled, parses the status and returns a map of
+// currently-online IPv4 address on the Tailnet.
+func (p SocketStatusProvider) TailnetMap() (TailnetMap, error) {
+	path := p.Path
+	if path == "" {
+		path = DefaultTailscaledSocket
 	}
-	tmap := tailnetMap{}
+	tmap := TailnetMap{}
 
 	// Fake Tailscale's HTTP-over-UDS communication with tailscaled.
 	transport := &http.Transport{
 		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
-			return net.Dial("unix", "/var/run/tailscale/tailscaled.sock")
+			return net.Dial("unix", path)
 		},
 	}
 	client := &http.Client{
@@ -479,39 +2978,96 @@ func getTailnetMap() (tailnetMap, error) {
 	}
 
 	// Decode the response.
+	type peerStatus struct {
+		DNSName       string         `json:"DNSName"`
+		Online        bool           `json:"Online"`
+		TailscaleIPs  []netip.Addr   `json:"TailscaleIPs"`
+		PrimaryRoutes []netip.Prefix `json:"PrimaryRoutes"`
+		Tags          []string       `json:"Tags"`
+	}
 	var status struct {
-		TailscaleIPs []netip.Addr `json:"TailscaleIPs"`
-		Peer         map[string]struct {
-			Online       bool         `json:"Online"`
-			TailscaleIPs []netip.Addr `json:"TailscaleIPs"`
-		} `json:"Peer"`
+		TailscaleIPs []netip.Addr          `json:"TailscaleIPs"`
+		Self         peerStatus            `json:"Self"`
+		Peer         map[string]peerStatus `json:"Peer"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
 		return tmap, fmt.Errorf("Cannot decode tailnet status: %v", err)
 	}
-	if addr, ok := findIPv4Addr(status.TailscaleIPs); ok {
+	if addr, ok := findIPv4Addr(status.TailscaleIPs, status.Self.PrimaryRoutes); ok {
 		tmap.LocalAddr = addr
 	} else {
 		return tmap, fmt.Errorf("Cannot find IPv4 Tailscale address for local host")
 	}
+	tmap.HostAddrs = make(map[string]netip.Addr)
+	tmap.Tags = make(map[netip.Addr][]string)
+	if status.Self.DNSName != "" {
+		tmap.HostAddrs[dnsKey(status.Self.DNSName)] = tmap.LocalAddr
+	}
+	if len(status.Self.Tags) > 0 {
+		tmap.Tags[tmap.LocalAddr] = status.Self.Tags
+	}
 	for _, peer := range status.Peer {
-		if !peer.Online {
+		addr, ok := findIPv4Addr(peer.TailscaleIPs, peer.PrimaryRoutes)
+		if !ok {
+			if peer.Online {
+				warnNoIPv4(peer.DNSName, peer.TailscaleIPs)
+			}
 			continue
 		}
-		if addr, ok := findIPv4Addr(peer.TailscaleIPs); ok {
+		if peer.DNSName != "" {
+			tmap.HostAddrs[dnsKey(peer.DNSName)] = addr
+		}
+		if len(peer.Tags) > 0 {
+			tmap.Tags[addr] = peer.Tags
+		}
+		if peer.Online {
 			tmap.PeerAddrs = append(tmap.PeerAddrs, addr)
 		}
 	}
 	return tmap, nil
 }
 
-// findIPv4Addr returns the first IPv4 address in the list, or the uninitialised
-// address. The bool is true in the former case.
-func findIPv4Addr(addrs []netip.Addr) (netip.Addr, bool) {
+// dnsKey normalizes a MagicDNS name for use as a key in TailnetMap.HostAddrs.
+func dnsKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// tailnetPrefix is the CGNAT range that Tailscale assigns node addresses from.
+var tailnetPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// findIPv4Addr returns the node's own IPv4 address from the list, or the
+// uninitialised address. The bool is true in the former case. Addresses within
+// the node's advertised subnet routes are skipped, and addresses within
+// tailnetPrefix are preferred over other IPv4 addresses.
+func findIPv4Addr(addrs []netip.Addr, routes []netip.Prefix) (netip.Addr, bool) {
+	var found netip.Addr
 	for _, addr := range addrs {
-		if addr.Is4() {
+		if !addr.Is4() || slices.ContainsFunc(routes, func(p netip.Prefix) bool {
+			return p.Contains(addr)
+		}) {
+			continue
+		}
+		if tailnetPrefix.Contains(addr) {
 			return addr, true
 		}
+		if !found.IsValid() {
+			found = addr
+		}
+	}
+	return found, found.IsValid()
+}
+
+// warnedNoIPv4 holds the names of peers that warnNoIPv4 has warned about.
+var warnedNoIPv4 sync.Map
+
+// warnNoIPv4 warns that the online peer with the given name is skipped because
+// it has no IPv4 address. As this happens on every status update, it only
+// warns once per peer.
+func warnNoIPv4(name string, addrs []netip.Addr) {
+	if _, warned := warnedNoIPv4.LoadOrStore(name, true); !warned {
+		logger.Warnf(
+			"Skipping online peer %s without IPv4 Tailscale address (has %v), "+
+				"its services won't be found", name, addrs,
+		)
 	}
-	return netip.Addr{}, false
 }
@@ -1,8 +1,11 @@
 package minidisc
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -10,17 +13,22 @@ import (
 	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 var (
-	fakeTailnetMap *tailnetMap        = nil
+	fakeTailnetMap *TailnetMap        = nil
 	testServers    []*httptest.Server = nil
 	registry       *Registry          = nil
+	delegate       *Registry          = nil
 )
 
 func TestMain(m *testing.M) {
@@ -31,9 +39,16 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// fakeStatusProvider returns fakeTailnetMap, which tests modify as needed.
+type fakeStatusProvider struct{}
+
+func (fakeStatusProvider) TailnetMap() (TailnetMap, error) {
+	return *fakeTailnetMap, nil
+}
+
 func setupEnv() {
-	fakeTailnetMap = &tailnetMap{}
-	tailnetMapForTesting = fakeTailnetMap
+	fakeTailnetMap = &TailnetMap{}
+	SetStatusProvider(fakeStatusProvider{})
 	setupRegistry()
 	setupDelegate()
 	setupPeers()
@@ -53,14 +68,13 @@ func setupRegistry() {
 
 func setupDelegate() {
 	// This is essentially the same as setupRegistry() but runs after, so the
-	// registry will end up as delegate. This is non-deterministic - sleep a
-	// little to get this closer to determinism.
-	time.Sleep(12 * time.Millisecond)
-	registry, err := StartRegistry()
+	// registry will end up as delegate.
+	var err error
+	delegate, err = StartRegistry()
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := registry.AdvertiseService(24, "oof", nil); err != nil {
+	if err := delegate.AdvertiseService(24, "oof", nil); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -94,6 +108,23 @@ func setupPeers() {
 	}
 }
 
+// newTestRegistry returns a registry that isn't connected to the network, for
+// testing its HTTP handlers directly.
+func newTestRegistry() *Registry {
+	return &Registry{
+		localAddr:     netip.MustParseAddr("127.0.0.2"),
+		port:          DefaultPort,
+		status:        fakeStatusProvider{},
+		localServices: []Service{},
+		maxDelegates:  DefaultMaxDelegates,
+		queryTimeout:  DefaultQueryTimeout,
+		leaderClient:  newLeaderClient(),
+
+		watchdogInterval:  DefaultWatchdogInterval,
+		leaderPingTimeout: DefaultLeaderPingTimeout,
+	}
+}
+
 func cleanup() {
 	for _, srv := range testServers {
 		srv.CloseClientConnections()
@@ -125,6 +156,10 @@ func TestServiceMatches(t *testing.T) {
 		{"subset labels", base, true, map[string]string{"env": "prod"}},
 		{"extra label", base, false, map[string]string{"env": "prod", "x": "y"}},
 		{"name mismatch", other, false, nil},
+		{"any value", base, true, map[string]string{"env": AnyLabelValue}},
+		{"any value and exact", base, true, map[string]string{"env": "*", "v": "1"}},
+		{"any value mismatch", base, false, map[string]string{"env": "*", "v": "2"}},
+		{"any value missing", base, false, map[string]string{"region": "*"}},
 	}
 	for _, c := range cases {
 		t.Run(c.title, func(t *testing.T) {
@@ -152,20 +187,68 @@ func TestListServices(t *testing.T) {
 	if err != nil {
 		t.Errorf("ListServices failed: %v", err)
 	}
+	delegate.mutex.Lock()
+	delegateAddr := delegate.addr
+	delegate.mutex.Unlock()
+	// Only the real registries record when services were advertised.
+	for i, s := range ss {
+		local := s.Name == "foo" || s.Name == "oof"
+		if s.RegisteredAt.IsZero() == local {
+			t.Errorf("Unexpected RegisteredAt for %s: %v", s.Name, s.RegisteredAt)
+		}
+		ss[i].RegisteredAt = time.Time{}
+	}
+	// The result is sorted, so it can be compared directly.
 	expected := []Service{
-		{"foo", map[string]string{}, netip.MustParseAddrPort("127.0.0.2:42")},
-		{"oof", map[string]string{}, netip.MustParseAddrPort("127.0.0.2:24")},
-		{"bar", map[string]string{}, netip.MustParseAddrPort("127.0.0.3:42")},
-		{"baz", map[string]string{}, netip.MustParseAddrPort("127.0.0.4:42")},
-	}
-	sFunc := func(a, b Service) int { return strings.Compare(a.Name, b.Name) }
-	slices.SortFunc(ss, sFunc)
-	slices.SortFunc(expected, sFunc)
-	if !reflect.DeepEqual(ss, expected) {
+		{
+			Name:     "bar",
+			Labels:   map[string]string{},
+			AddrPort: netip.MustParseAddrPort("127.0.0.3:42"),
+			Target:   "tcp://127.0.0.3:42",
+			Source:   netip.MustParseAddrPort("127.0.0.3:28004"),
+		},
+		{
+			Name:     "baz",
+			Labels:   map[string]string{},
+			AddrPort: netip.MustParseAddrPort("127.0.0.4:42"),
+			Target:   "tcp://127.0.0.4:42",
+			Source:   netip.MustParseAddrPort("127.0.0.4:28004"),
+		},
+		{
+			Name:     "foo",
+			Labels:   map[string]string{},
+			AddrPort: netip.MustParseAddrPort("127.0.0.2:42"),
+			Target:   "tcp://127.0.0.2:42",
+			Source:   netip.MustParseAddrPort("127.0.0.2:28004"),
+		},
+		{
+			Name:     "oof",
+			Labels:   map[string]string{},
+			AddrPort: netip.MustParseAddrPort("127.0.0.2:24"),
+			Target:   "tcp://127.0.0.2:24",
+			Source:   delegateAddr,
+		},
+	}
+	if !slices.EqualFunc(ss, expected, Service.Equal) {
 		t.Errorf("Wrong ListServices results.\nExpected: %v\nActual: %v", expected, ss)
 	}
 }
 
+func TestListServicesLocalFirst(t *testing.T) {
+	ss, err := ListServicesWithOptions(QueryOptions{LocalFirst: true})
+	if err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	var names []string
+	for _, s := range ss {
+		names = append(names, s.Name)
+	}
+	// The local leader and its delegate come first, then the peers in order.
+	if want := []string{"foo", "oof", "bar", "baz"}; !slices.Equal(names, want) {
+		t.Errorf("Expected services %v, got %v", want, names)
+	}
+}
+
 func TestFindService(t *testing.T) {
 	ap, err := FindService("baz", nil)
 	if err != nil {
@@ -179,8 +262,8 @@ func TestFindService(t *testing.T) {
 
 func TestServiceManagement(t *testing.T) {
 	_, err := FindService("findme", map[string]string{"env": "prod"})
-	if err == nil {
-		t.Errorf("Found non-existent service 'findme'")
+	if !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("Expected ErrServiceNotFound for 'findme', got %v", err)
 	}
 
 	registry.AdvertiseService(1234, "findme", map[string]string{"env": "prod", "x": "y"})
@@ -199,3 +282,2292 @@ func TestServiceManagement(t *testing.T) {
 		t.Errorf("Found unlisted service 'findme'")
 	}
 }
+
+func TestSetDialer(t *testing.T) {
+	var mu sync.Mutex
+	var dialed []string
+	SetDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})
+	defer SetDialer((&net.Dialer{}).DialContext)
+
+	// Force new connections, idle ones would bypass the dialer.
+	transport.CloseIdleConnections()
+	if _, err := ListServices(); err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Contains(dialed, "127.0.0.3:28004") {
+		t.Errorf("Custom dialer wasn't used for peer query, dialed: %v", dialed)
+	}
+}
+
+func TestAuthToken(t *testing.T) {
+	r := newTestRegistry()
+	r.authToken = "s3cret"
+	cases := []struct {
+		title string
+		path  string
+		auth  string
+		want  int
+	}{
+		{"services without token", "/services", "", http.StatusUnauthorized},
+		{"services with wrong token", "/services", "Bearer nope", http.StatusUnauthorized},
+		{"services with token", "/services", "Bearer s3cret", http.StatusOK},
+		{"ping without token", "/ping", "", http.StatusUnauthorized},
+		{"ping with token", "/ping", "Bearer s3cret", http.StatusOK},
+		{"add-delegate without token", "/add-delegate", "", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			req := httptest.NewRequest("GET", c.path, nil)
+			if c.auth != "" {
+				req.Header.Set("Authorization", c.auth)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != c.want {
+				t.Errorf("Expected status %d, got %d", c.want, rec.Code)
+			}
+		})
+	}
+}
+
+func TestAddDelegateMalformedBody(t *testing.T) {
+	r := newTestRegistry()
+	req := httptest.NewRequest("POST", "/add-delegate", strings.NewReader("{garbage"))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if len(r.delegates) != 0 {
+		t.Errorf("Malformed request added delegates: %v", r.delegates)
+	}
+}
+
+func TestAddDelegateValidation(t *testing.T) {
+	minPort, _ := ephemeralPortRange()
+	cases := []struct {
+		title string
+		addr  netip.AddrPort
+		want  int
+	}{
+		{"local ephemeral port", netip.AddrPortFrom(netip.MustParseAddr("127.0.0.2"), minPort), http.StatusOK},
+		{"cross-host delegate", netip.AddrPortFrom(netip.MustParseAddr("127.0.0.3"), minPort), http.StatusForbidden},
+		{"privileged port", netip.MustParseAddrPort("127.0.0.2:80"), http.StatusForbidden},
+		{"leader port", netip.MustParseAddrPort("127.0.0.2:28004"), http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			r := newTestRegistry()
+			body := fmt.Sprintf(`{"addrPort":"%s"}`, c.addr)
+			req := httptest.NewRequest("POST", "/add-delegate", strings.NewReader(body))
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != c.want {
+				t.Errorf("Expected status %d, got %d", c.want, rec.Code)
+			}
+			if added := len(r.delegates) > 0; added != (c.want == http.StatusOK) {
+				t.Errorf("Unexpected delegates: %v", r.delegates)
+			}
+		})
+	}
+}
+
+func TestMaxDelegates(t *testing.T) {
+	postDelegate := func(r *Registry, ap netip.AddrPort) int {
+		body := fmt.Sprintf(`{"addrPort":"%s"}`, ap)
+		req := httptest.NewRequest("POST", "/add-delegate", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	// A live delegate that answers pings.
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := httptest.NewUnstartedServer(newTestRegistry())
+	live.Listener = ln
+	live.Start()
+	defer live.Close()
+	liveAddr := netip.MustParseAddrPort(ln.Addr().String())
+	// A dead delegate, nothing is listening there.
+	deadAddr := netip.AddrPortFrom(liveAddr.Addr(), liveAddr.Port()+1)
+	newAddr := netip.AddrPortFrom(liveAddr.Addr(), liveAddr.Port()+2)
+
+	r := newTestRegistry()
+	r.maxDelegates = 1
+	r.delegates = []netip.AddrPort{deadAddr}
+	// Stop forwarding the live delegate's events, so it can shut down.
+	defer r.removeDelegate(liveAddr)
+	if code := postDelegate(r, liveAddr); code != http.StatusOK {
+		t.Errorf("Expected dead delegate to be pruned, got status %d", code)
+	}
+	if code := postDelegate(r, newAddr); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d with live delegates, got %d", http.StatusServiceUnavailable, code)
+	}
+	if !reflect.DeepEqual(r.delegates, []netip.AddrPort{liveAddr}) {
+		t.Errorf("Expected delegates %v, got %v", []netip.AddrPort{liveAddr}, r.delegates)
+	}
+}
+
+func TestPruneInterval(t *testing.T) {
+	oldAddr := fakeTailnetMap.LocalAddr
+	fakeTailnetMap.LocalAddr = netip.MustParseAddr("127.0.0.28")
+	defer func() { fakeTailnetMap.LocalAddr = oldAddr }()
+	r, err := StartRegistryWithOptions(StartRegistryOptions{PruneInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Role() != RoleLeader {
+		t.Fatalf("Expected leader, got %s", r.Role())
+	}
+	// A dead delegate, nothing is listening there.
+	dead := netip.MustParseAddrPort("127.0.0.28:1")
+	r.mutex.Lock()
+	r.delegates = append(r.delegates, dead)
+	r.mutex.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mutex.Lock()
+		n := len(r.delegates)
+		r.mutex.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected dead delegate to be pruned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServicesETag(t *testing.T) {
+	r := newTestRegistry()
+	r.localServices = []Service{
+		{Name: "etag", Labels: map[string]string{}, AddrPort: netip.MustParseAddrPort("127.0.0.2:4242"), Target: "tcp://127.0.0.2:4242"},
+	}
+	var statuses []int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		statuses = append(statuses, rec.Code)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	ap := netip.MustParseAddrPort(srv.Listener.Addr().String())
+
+	first, err := getRemoteServices(context.Background(), ap, "", DefaultQueryTimeout)
+	if err != nil {
+		t.Fatalf("getRemoteServices failed: %v", err)
+	}
+	second, err := getRemoteServices(context.Background(), ap, "", DefaultQueryTimeout)
+	if err != nil {
+		t.Fatalf("getRemoteServices failed: %v", err)
+	}
+	if !reflect.DeepEqual(first, second) || !reflect.DeepEqual(first, r.localServices) {
+		t.Errorf("Expected %v twice, got %v and %v", r.localServices, first, second)
+	}
+	expected := []int{http.StatusOK, http.StatusNotModified}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("Expected statuses %v, got %v", expected, statuses)
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	c := &serviceCache{entries: make(map[responseKey]cachedResponse), max: 2}
+	ap := netip.MustParseAddrPort("127.0.0.2:28004")
+	key := responseKey{addrPort: ap, version: ProtocolVersion}
+	services := []Service{{Name: "cached", Labels: map[string]string{"env": "prod"}}}
+	c.put(key, cachedResponse{etag: "a", services: services})
+	services[0].Labels["env"] = "dev"
+
+	got, ok := c.get(key)
+	if !ok || got.services[0].Labels["env"] != "prod" {
+		t.Fatalf("Expected cached copy with env=prod, got %v", got)
+	}
+	got.services[0].Labels["env"] = "dev"
+	if again, _ := c.get(key); again.services[0].Labels["env"] != "prod" {
+		t.Errorf("Expected cache to hand out copies, got %v", again)
+	}
+	for _, other := range []responseKey{
+		{addrPort: ap, version: ProtocolVersion, token: "secret"},
+		{addrPort: ap, version: ProtocolVersion, path: "127.0.0.3:28004"},
+		{addrPort: ap, version: 1},
+	} {
+		if _, ok := c.get(other); ok {
+			t.Errorf("Expected no entry for %+v", other)
+		}
+	}
+
+	c.put(responseKey{addrPort: ap, token: "1"}, cachedResponse{etag: "b"})
+	c.put(responseKey{addrPort: ap, token: "2"}, cachedResponse{etag: "c"})
+	if len(c.entries) != 2 {
+		t.Errorf("Expected 2 entries, got %d", len(c.entries))
+	}
+}
+
+func TestServicesGzip(t *testing.T) {
+	r := newTestRegistry()
+	r.localServices = []Service{
+		{Name: "gzip", Labels: map[string]string{"env": "prod"}, AddrPort: netip.MustParseAddrPort("127.0.0.2:4242"), Target: "tcp://127.0.0.2:4242"},
+	}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// Clients that don't ask for gzip get plain JSON.
+	req := httptest.NewRequest("GET", "/services", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Expected no Content-Encoding, got %q", enc)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("Expected gzip Content-Encoding, got %q", enc)
+	}
+
+	ss, err := getRemoteServices(context.Background(), netip.MustParseAddrPort(srv.Listener.Addr().String()), "", DefaultQueryTimeout)
+	if err != nil {
+		t.Fatalf("getRemoteServices failed: %v", err)
+	}
+	if !reflect.DeepEqual(ss, r.localServices) {
+		t.Errorf("Expected %v, got %v", r.localServices, ss)
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	r := newTestRegistry()
+	cases := []struct {
+		title string
+		sent  string
+		want  string
+	}{
+		{"missing header", "", "1"},
+		{"version 1", "1", "1"},
+		{"current version", "2", "2"},
+		{"newer client", "42", "2"},
+		{"garbage", "v2", "1"},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/services", nil)
+			if c.sent != "" {
+				req.Header.Set(versionHeader, c.sent)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if got := rec.Header().Get(versionHeader); got != c.want {
+				t.Errorf("Expected version %s, got %s", c.want, got)
+			}
+		})
+	}
+}
+
+func TestUnixService(t *testing.T) {
+	r := newTestRegistry()
+	if err := r.AdvertiseUnixService("relative.sock", "unix", nil); err == nil {
+		t.Errorf("Expected error for relative socket path")
+	}
+	if err := r.AdvertiseUnixService("/run/app.sock", "unix", nil); err != nil {
+		t.Fatalf("AdvertiseUnixService failed: %v", err)
+	}
+	if err := r.AdvertiseService(4444, "tcp", nil); err != nil {
+		t.Fatalf("AdvertiseService failed: %v", err)
+	}
+
+	for version, want := range map[string][]string{
+		"1": {"tcp"},
+		"2": {"unix", "tcp"},
+	} {
+		req := httptest.NewRequest("GET", "/services", nil)
+		req.Header.Set(versionHeader, version)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		ss, err := decodeServices(rec.Body.Bytes(), negotiateVersion(rec.Header()))
+		if err != nil {
+			t.Fatalf("Bad response for version %s: %v", version, err)
+		}
+		var names []string
+		for _, s := range ss {
+			names = append(names, s.Name)
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("Expected %v for version %s, got %v", want, version, names)
+		}
+	}
+
+	ss := r.LocalServices()
+	if path, ok := ss[0].UnixSocketPath(); !ok || path != "/run/app.sock" {
+		t.Errorf("Expected socket path /run/app.sock, got %q", path)
+	}
+	if _, ok := ss[1].UnixSocketPath(); ok {
+		t.Errorf("Expected no socket path for TCP service")
+	}
+	if err := r.UnlistService(0); err == nil {
+		t.Errorf("UnlistService shouldn't remove Unix services")
+	}
+	if err := r.UnlistUnixService("/run/app.sock"); err != nil {
+		t.Errorf("UnlistUnixService failed: %v", err)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	r := newTestRegistry()
+	annotations := map[string]string{"description": "Annotated service"}
+	if err := r.AdvertiseService(4343, "annotated", nil, WithAnnotations(annotations)); err != nil {
+		t.Fatalf("AdvertiseService failed: %v", err)
+	}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	ss, err := getRemoteServices(context.Background(), netip.MustParseAddrPort(srv.Listener.Addr().String()), "", DefaultQueryTimeout)
+	if err != nil {
+		t.Fatalf("getRemoteServices failed: %v", err)
+	}
+	if len(ss) != 1 || !reflect.DeepEqual(ss[0].Annotations, annotations) {
+		t.Errorf("Expected annotations %v, got %v", annotations, ss)
+	}
+	if !serviceMatches(ss[0], "annotated", nil) {
+		t.Errorf("Annotations should not affect matching")
+	}
+	if serviceMatches(ss[0], "annotated", annotations) {
+		t.Errorf("Annotations should not be matched as labels")
+	}
+}
+
+func TestLookupHostname(t *testing.T) {
+	fakeTailnetMap.HostAddrs = map[string]netip.Addr{
+		"printer.tailnet.ts.net": netip.MustParseAddr("100.64.0.9"),
+	}
+	defer func() { fakeTailnetMap.HostAddrs = nil }()
+
+	name, err := LookupHostname(netip.MustParseAddr("100.64.0.9"))
+	if err != nil || name != "printer.tailnet.ts.net" {
+		t.Errorf("Expected printer.tailnet.ts.net, got %q, %v", name, err)
+	}
+	if _, err := LookupHostname(netip.MustParseAddr("100.64.0.10")); err == nil {
+		t.Errorf("Expected error for unknown address")
+	}
+}
+
+func TestScheme(t *testing.T) {
+	r := newTestRegistry()
+	if err := r.AdvertiseService(4344, "grpc", nil, WithScheme("grpc")); err != nil {
+		t.Fatalf("AdvertiseService failed: %v", err)
+	}
+	if err := r.AdvertiseService(4345, "unspecified", nil); err != nil {
+		t.Fatalf("AdvertiseService failed: %v", err)
+	}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	ss, err := getRemoteServices(context.Background(), netip.MustParseAddrPort(srv.Listener.Addr().String()), "", DefaultQueryTimeout)
+	if err != nil {
+		t.Fatalf("getRemoteServices failed: %v", err)
+	}
+	if len(ss) != 2 || ss[0].Scheme != "grpc" || ss[1].Scheme != "" {
+		t.Errorf("Expected schemes grpc and none, got %v", ss)
+	}
+}
+
+func TestAdvertiseRemoteServiceHost(t *testing.T) {
+	fakeTailnetMap.HostAddrs = map[string]netip.Addr{
+		"printer.tailnet.ts.net": netip.MustParseAddr("100.64.0.9"),
+		"loopy.tailnet.ts.net":   netip.MustParseAddr("127.0.0.3"),
+	}
+	defer func() { fakeTailnetMap.HostAddrs = nil }()
+
+	cases := []struct {
+		title    string
+		hostPort string
+		want     netip.AddrPort
+		wantErr  bool
+	}{
+		{"literal address", "100.64.0.1:80", netip.MustParseAddrPort("100.64.0.1:80"), false},
+		{"fully-qualified name", "printer.tailnet.ts.net:9100", netip.MustParseAddrPort("100.64.0.9:9100"), false},
+		{"short name", "Printer:9101", netip.MustParseAddrPort("100.64.0.9:9101"), false},
+		{"unknown host", "scanner:9100", netip.AddrPort{}, true},
+		{"non-tailnet address", "loopy:80", netip.AddrPort{}, true},
+		{"bad port", "printer:http", netip.AddrPort{}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			r := newTestRegistry()
+			err := r.AdvertiseRemoteServiceHost(c.hostPort, "svc", nil)
+			if c.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %s", c.hostPort)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AdvertiseRemoteServiceHost failed: %v", err)
+			}
+			if got := r.localServices[0].AddrPort; got != c.want {
+				t.Errorf("Expected address %s, got %s", c.want, got)
+			}
+		})
+	}
+}
+
+func TestTailnetUnavailable(t *testing.T) {
+	SetStatusProvider(SocketStatusProvider{Path: "/nonexistent/tailscaled.sock"})
+	defer SetStatusProvider(fakeStatusProvider{})
+	_, err := FindService("foo", nil)
+	if !errors.Is(err, ErrTailnetUnavailable) {
+		t.Errorf("Expected ErrTailnetUnavailable, got %v", err)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	cases := []struct {
+		title string
+		opts  QueryOptions
+		want  time.Duration
+	}{
+		{"default", QueryOptions{}, DefaultQueryTimeout},
+		{"custom", QueryOptions{Timeout: 5 * time.Second}, 5 * time.Second},
+		{"below minimum", QueryOptions{Timeout: time.Millisecond}, MinQueryTimeout},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			if got := c.opts.timeout(); got != c.want {
+				t.Errorf("Expected timeout %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestPingRank(t *testing.T) {
+	r := newTestRegistry()
+	r.delegates = []netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.2:40001"),
+		netip.MustParseAddrPort("127.0.0.2:40002"),
+	}
+	cases := []struct {
+		title    string
+		delegate string
+		want     string
+	}{
+		{"no delegate", "", ""},
+		{"oldest delegate", "127.0.0.2:40001", "0"},
+		{"second delegate", "127.0.0.2:40002", "1"},
+		{"unknown delegate", "127.0.0.2:40003", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ping", nil)
+			req.Header.Set(delegateHeader, c.delegate)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if got := rec.Header().Get(rankHeader); got != c.want {
+				t.Errorf("Expected rank %q, got %q", c.want, got)
+			}
+		})
+	}
+}
+
+func TestLeaderPingTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.7:28004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(wrt http.ResponseWriter, req *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+		},
+	))
+	slow.Listener = ln
+	slow.Start()
+	defer slow.Close()
+
+	r := newTestRegistry()
+	r.localAddr = netip.MustParseAddr("127.0.0.7")
+	self := netip.MustParseAddrPort("127.0.0.7:40001")
+	r.leaderPingTimeout = 50 * time.Millisecond
+	if r.leaderIsAlive(self) {
+		t.Errorf("Expected slow leader to time out")
+	}
+	r.leaderPingTimeout = time.Second
+	if !r.leaderIsAlive(self) {
+		t.Errorf("Expected slow leader to be alive with longer timeout")
+	}
+}
+
+func TestLeaderRestart(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.21:28004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLeader := func(nonce string) *Registry {
+		leader := newTestRegistry()
+		leader.localAddr = netip.MustParseAddr("127.0.0.21")
+		leader.nonce = nonce
+		return leader
+	}
+	var mutex sync.Mutex
+	leader := newLeader("first")
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(wrt http.ResponseWriter, req *http.Request) {
+			mutex.Lock()
+			l := leader
+			mutex.Unlock()
+			l.ServeHTTP(wrt, req)
+		},
+	))
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	r := newTestRegistry()
+	r.localAddr = netip.MustParseAddr("127.0.0.21")
+	self := netip.MustParseAddrPort("127.0.0.21:40001")
+	if err := r.verifyLeader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.registerWithLeader(self); err != nil {
+		t.Fatal(err)
+	}
+	if !r.leaderIsAlive(self) || r.leaderNonce != "first" {
+		t.Fatalf("Expected leader nonce first, got %q", r.leaderNonce)
+	}
+
+	mutex.Lock()
+	leader = newLeader("second")
+	mutex.Unlock()
+	if !r.leaderIsAlive(self) {
+		t.Fatalf("Expected restarted leader to be alive")
+	}
+	if r.leaderNonce != "second" {
+		t.Errorf("Expected leader nonce second, got %q", r.leaderNonce)
+	}
+	if !slices.Equal(leader.delegates, []netip.AddrPort{self}) {
+		t.Errorf("Expected delegate to register again, got %v", leader.delegates)
+	}
+}
+
+func TestNonce(t *testing.T) {
+	r := newTestRegistry()
+	r.nonce = "abc"
+	for _, path := range []string{"/ping", "/services"} {
+		wrt := httptest.NewRecorder()
+		r.ServeHTTP(wrt, httptest.NewRequest("GET", path, nil))
+		if got := wrt.Header().Get(nonceHeader); got != "abc" {
+			t.Errorf("Expected nonce abc on %s, got %q", path, got)
+		}
+	}
+}
+
+func TestDelegateSurvivesLeaderRestart(t *testing.T) {
+	// Swapping the registry behind the leader port restarts the leader without
+	// the watchdog ever seeing it down.
+	ln, err := net.Listen("tcp", "127.0.0.22:28004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLeader := func(nonce string) *Registry {
+		leader := newTestRegistry()
+		leader.localAddr = netip.MustParseAddr("127.0.0.22")
+		leader.nonce = nonce
+		return leader
+	}
+	var leader atomic.Pointer[Registry]
+	leader.Store(newLeader("first"))
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(wrt http.ResponseWriter, req *http.Request) {
+			leader.Load().ServeHTTP(wrt, req)
+		},
+	))
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	oldAddr := fakeTailnetMap.LocalAddr
+	fakeTailnetMap.LocalAddr = netip.MustParseAddr("127.0.0.22")
+	defer func() { fakeTailnetMap.LocalAddr = oldAddr }()
+	r, err := StartRegistryWithOptions(StartRegistryOptions{
+		WatchdogInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Role() != RoleDelegate {
+		t.Fatalf("Expected delegate role, got %v", r.Role())
+	}
+	if err := r.AdvertiseService(4000, "survivor", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	leader.Store(newLeader("second"))
+	ap := netip.MustParseAddrPort("127.0.0.22:28004")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		services, err := getRemoteServices(context.Background(), ap, "", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(services) == 1 && services[0].Name == "survivor" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Delegate's services didn't reappear, got %v", services)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.Role() != RoleDelegate {
+		t.Errorf("Expected delegate to stay delegate, got %v", r.Role())
+	}
+}
+
+func TestLeaderConnectionReuse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.23:28004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader := newTestRegistry()
+	leader.localAddr = netip.MustParseAddr("127.0.0.23")
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(leader)
+	srv.Listener = ln
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	r := newTestRegistry()
+	r.localAddr = netip.MustParseAddr("127.0.0.23")
+	self := netip.MustParseAddrPort("127.0.0.23:40001")
+	if err := r.registerWithLeader(self); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if !r.leaderIsAlive(self) {
+			t.Fatal("Expected leader to be alive")
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("Expected one connection to the leader, got %d", n)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	if d := jitter(0); d != 0 {
+		t.Errorf("Expected no jitter for zero range, got %v", d)
+	}
+	for range 100 {
+		if d := jitter(promotionStagger / 2); d < 0 || d >= promotionStagger/2 {
+			t.Fatalf("Jitter %v out of range", d)
+		}
+	}
+}
+
+func TestForeignLeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.5:28004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign := httptest.NewUnstartedServer(http.NotFoundHandler())
+	foreign.Listener = ln
+	foreign.Start()
+	defer foreign.Close()
+
+	oldAddr := fakeTailnetMap.LocalAddr
+	fakeTailnetMap.LocalAddr = netip.MustParseAddr("127.0.0.5")
+	defer func() { fakeTailnetMap.LocalAddr = oldAddr }()
+	if _, err := StartRegistry(); !errors.Is(err, errForeignLeader) {
+		t.Errorf("Expected errForeignLeader, got %v", err)
+	}
+}
+
+func TestServicesLocalOnly(t *testing.T) {
+	delegate := newTestRegistry()
+	delegate.localServices = []Service{
+		{Name: "delegated", Labels: map[string]string{}, AddrPort: netip.MustParseAddrPort("127.0.0.2:4444")},
+	}
+	srv := httptest.NewServer(delegate)
+	defer srv.Close()
+
+	r := newTestRegistry()
+	r.localServices = []Service{
+		{Name: "local", Labels: map[string]string{}, AddrPort: netip.MustParseAddrPort("127.0.0.2:4445")},
+	}
+	r.delegates = []netip.AddrPort{netip.MustParseAddrPort(srv.Listener.Addr().String())}
+	for path, want := range map[string]int{"/services": 2, "/services?local=true": 1} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var ss []Service
+		if err := json.Unmarshal(rec.Body.Bytes(), &ss); err != nil {
+			t.Fatalf("Bad response from %s: %v", path, err)
+		}
+		if len(ss) != want {
+			t.Errorf("Expected %d services from %s, got %v", want, path, ss)
+		}
+	}
+}
+
+func TestSharedRegistry(t *testing.T) {
+	r1, err := SharedRegistry()
+	if err != nil {
+		t.Fatalf("SharedRegistry failed: %v", err)
+	}
+	r2, err := SharedRegistry()
+	if err != nil {
+		t.Fatalf("SharedRegistry failed: %v", err)
+	}
+	if r1 != r2 {
+		t.Errorf("SharedRegistry returned different registries")
+	}
+	if r1 == registry || r1 == delegate {
+		t.Errorf("SharedRegistry returned a registry started with StartRegistry")
+	}
+	if err := r1.AdvertiseService(4711, "shared", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer r1.UnlistService(4711)
+	if _, err := FindService("shared", nil); err != nil {
+		t.Errorf("Service on shared registry not found: %v", err)
+	}
+}
+
+func TestRole(t *testing.T) {
+	if role := registry.Role(); role != RoleLeader {
+		t.Errorf("Expected first registry to be %v, got %v", RoleLeader, role)
+	}
+	if _, ok := registry.LeaderAddr(); ok {
+		t.Errorf("Leader shouldn't report a leader address")
+	}
+	if role := delegate.Role(); role != RoleDelegate {
+		t.Errorf("Expected second registry to be %v, got %v", RoleDelegate, role)
+	}
+	expected := netip.MustParseAddrPort("127.0.0.2:28004")
+	if ap, ok := delegate.LeaderAddr(); !ok || ap != expected {
+		t.Errorf("Expected leader address %s, got %s", expected, ap)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	r := newTestRegistry()
+	r.role = RoleLeader
+	r.addr = netip.MustParseAddrPort("127.0.0.2:28004")
+	r.delegates = []netip.AddrPort{netip.MustParseAddrPort("127.0.0.2:40001")}
+	r.startTime = time.Now().Add(-time.Minute)
+	if err := r.AdvertiseService(4646, "status", nil); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	var status RegistryStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Bad /status response: %v", err)
+	}
+	if status.Role != "leader" || status.Addr != r.addr || status.ServiceCount != 1 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+	if !reflect.DeepEqual(status.Delegates, r.delegates) {
+		t.Errorf("Expected delegates %v, got %v", r.delegates, status.Delegates)
+	}
+	if status.UptimeSeconds < 60 {
+		t.Errorf("Expected uptime of at least 60s, got %v", status.UptimeSeconds)
+	}
+}
+
+func TestFindAmbiguous(t *testing.T) {
+	svc := func(name, addr string, labels map[string]string) Service {
+		return Service{Name: name, Labels: labels, AddrPort: netip.MustParseAddrPort(addr)}
+	}
+	ss := []Service{
+		svc("dup", "100.64.0.1:80", nil),
+		svc("dup", "100.64.0.2:80", map[string]string{}),
+		svc("dup", "100.64.0.3:80", map[string]string{"env": "prod"}),
+		svc("same", "100.64.0.1:81", nil),
+		svc("same", "100.64.0.1:81", nil), // Listed twice, but not ambiguous.
+		svc("lbl", "100.64.0.1:82", map[string]string{"a": "1", "b": "2"}),
+		svc("lbl", "100.64.0.2:82", map[string]string{"b": "2", "a": "1"}),
+	}
+	got := findAmbiguous(ss)
+	expected := [][]Service{
+		{ss[0], ss[1]},
+		{ss[5], ss[6]},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestWarnAmbiguous(t *testing.T) {
+	l := &warningLogger{}
+	oldLogger := GetLogger()
+	SetLogger(l)
+	defer SetLogger(oldLogger)
+	group := []Service{
+		{Name: "warn-once", AddrPort: netip.MustParseAddrPort("100.64.0.1:80")},
+		{Name: "warn-once", AddrPort: netip.MustParseAddrPort("100.64.0.2:80")},
+	}
+	warnAmbiguous(group)
+	warnAmbiguous(group)
+	if len(l.warnings) != 1 || !strings.Contains(l.warnings[0], "warn-once") {
+		t.Errorf("Expected one warning about warn-once, got %q", l.warnings)
+	}
+	// Another instance makes it a new group, worth another warning.
+	group = append(group, Service{Name: "warn-once", AddrPort: netip.MustParseAddrPort("100.64.0.3:80")})
+	warnAmbiguous(group)
+	if len(l.warnings) != 2 {
+		t.Errorf("Expected a warning about the new group, got %q", l.warnings)
+	}
+}
+
+func TestClose(t *testing.T) {
+	oldAddr := fakeTailnetMap.LocalAddr
+	fakeTailnetMap.LocalAddr = netip.MustParseAddr("127.0.0.6")
+	defer func() { fakeTailnetMap.LocalAddr = oldAddr }()
+	leader, err := StartRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	delegate, err := StartRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delegate.Role() != RoleDelegate {
+		t.Fatalf("Expected delegate role, got %v", delegate.Role())
+	}
+	delegateAddr := delegate.addr
+
+	if err := delegate.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if leader.ping(delegateAddr) {
+		t.Errorf("Delegate still serving after Close")
+	}
+	leader.mutex.Lock()
+	deregistered := !slices.Contains(leader.delegates, delegateAddr)
+	leader.mutex.Unlock()
+	if !deregistered {
+		t.Errorf("Delegate didn't deregister from leader")
+	}
+	if err := leader.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	ln, err := net.Listen("tcp4", "127.0.0.6:28004")
+	if err != nil {
+		t.Fatalf("Leader port not released after Close: %v", err)
+	}
+	ln.Close()
+	if err := leader.Close(); !errors.Is(err, ErrRegistryClosed) {
+		t.Errorf("Expected ErrRegistryClosed on second Close, got %v", err)
+	}
+}
+
+func TestStaticTailnet(t *testing.T) {
+	r, err := StartRegistryWithOptions(StartRegistryOptions{
+		StaticLocalAddr: netip.MustParseAddr("127.0.0.8"),
+		StaticPeers:     []netip.Addr{netip.MustParseAddr("127.0.0.3")},
+	})
+	if err != nil {
+		t.Fatalf("StartRegistryWithOptions failed: %v", err)
+	}
+	defer r.Close()
+	if err := r.AdvertiseService(4848, "static", nil); err != nil {
+		t.Fatalf("AdvertiseService failed: %v", err)
+	}
+	remote := netip.MustParseAddrPort("127.0.0.3:80")
+	if err := r.AdvertiseRemoteService(remote, "remote", nil); err != nil {
+		t.Errorf("Expected loopback remote service to be accepted: %v", err)
+	}
+
+	if _, ok := currentStatusProvider().(StaticStatusProvider); ok {
+		t.Errorf("Expected static registry to leave the global provider alone")
+	}
+
+	SetStaticTailnet(netip.MustParseAddr("127.0.0.8"), []netip.Addr{netip.MustParseAddr("127.0.0.3")})
+	defer SetStatusProvider(fakeStatusProvider{})
+	ss, err := ListServices()
+	if err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	var names []string
+	for _, s := range ss {
+		names = append(names, s.Name)
+	}
+	slices.Sort(names)
+	if want := []string{"bar", "remote", "static"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected services %v, got %v", want, names)
+	}
+}
+
+func TestRegistryStatusProvider(t *testing.T) {
+	status := StaticStatusProvider{Map: TailnetMap{
+		LocalAddr: netip.MustParseAddr("127.0.0.9"),
+		HostAddrs: map[string]netip.Addr{"printer.tailnet.ts.net": netip.MustParseAddr("100.64.0.9")},
+	}}
+	r, err := StartRegistryWithOptions(StartRegistryOptions{StatusProvider: status})
+	if err != nil {
+		t.Fatalf("StartRegistryWithOptions failed: %v", err)
+	}
+	defer r.Close()
+	if r.addr.Addr() != netip.MustParseAddr("127.0.0.9") {
+		t.Errorf("Expected registry on 127.0.0.9, got %s", r.addr)
+	}
+	if err := r.AdvertiseRemoteServiceHost("printer:9100", "printer", nil); err != nil {
+		t.Errorf("Expected host to resolve via registry's provider: %v", err)
+	}
+}
+
+func TestCheckRemoteAddr(t *testing.T) {
+	loopback := netip.MustParseAddrPort("127.0.0.3:80")
+	if err := checkRemoteAddr(loopback, fakeStatusProvider{}); err == nil {
+		t.Errorf("Expected non-Tailscale address to be rejected")
+	}
+	if err := checkRemoteAddr(netip.MustParseAddrPort("100.64.0.3:80"), fakeStatusProvider{}); err != nil {
+		t.Errorf("Expected Tailscale address to be accepted: %v", err)
+	}
+	if err := checkRemoteAddr(loopback, &StaticStatusProvider{}); err != nil {
+		t.Errorf("Expected static provider to accept any address: %v", err)
+	}
+}
+
+func TestTailnetMapPeers(t *testing.T) {
+	local := netip.MustParseAddr("100.64.0.1")
+	a := netip.MustParseAddr("100.64.0.2")
+	b := netip.MustParseAddr("100.64.0.3")
+	m := TailnetMap{LocalAddr: local, PeerAddrs: []netip.Addr{a, local, b, a}}
+	if got, want := m.Peers(), []netip.Addr{a, b}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected peers %v, got %v", want, got)
+	}
+	if got := (TailnetMap{LocalAddr: local}).Peers(); len(got) != 0 {
+		t.Errorf("Expected no peers, got %v", got)
+	}
+}
+
+func TestListServicesLocalOnce(t *testing.T) {
+	// Leader and delegate on the local host, which the status provider also
+	// lists as peer.
+	oldPeers := fakeTailnetMap.PeerAddrs
+	fakeTailnetMap.PeerAddrs = append(slices.Clone(oldPeers), fakeTailnetMap.LocalAddr)
+	defer func() { fakeTailnetMap.PeerAddrs = oldPeers }()
+
+	ss, err := ListServices()
+	if err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	counts := make(map[string]int)
+	for _, s := range ss {
+		counts[s.Name]++
+	}
+	for _, name := range []string{"foo", "oof"} {
+		if counts[name] != 1 {
+			t.Errorf("Expected %s once, got %d times in %v", name, counts[name], ss)
+		}
+	}
+}
+
+func TestDedupeServices(t *testing.T) {
+	leader := netip.MustParseAddrPort("127.0.0.2:28004")
+	other := netip.MustParseAddrPort("127.0.0.3:28004")
+	svc := Service{Name: "svc", Target: "tcp://127.0.0.2:42", Source: leader}
+	moved := svc
+	moved.Source = other
+	got := dedupeServices([]Service{svc, svc, moved})
+	if want := []Service{svc, moved}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+// startSlowPeer starts a fake registry at addr:28004 that doesn't answer until
+// the returned function is called, or the client gives up.
+func startSlowPeer(t *testing.T, addr string) func() {
+	ln, err := net.Listen("tcp", addr+":28004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	slow := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(wrt http.ResponseWriter, req *http.Request) {
+			select {
+			case <-req.Context().Done():
+			case <-release:
+			}
+		},
+	))
+	slow.Listener = ln
+	slow.Start()
+	oldPeers := fakeTailnetMap.PeerAddrs
+	fakeTailnetMap.PeerAddrs = append(slices.Clone(oldPeers), netip.MustParseAddr(addr))
+	return func() {
+		fakeTailnetMap.PeerAddrs = oldPeers
+		close(release)
+		slow.Close()
+	}
+}
+
+func TestListServicesDeadline(t *testing.T) {
+	defer startSlowPeer(t, "127.0.0.10")()
+	start := time.Now()
+	ss, err := ListServicesWithOptions(QueryOptions{Timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ListServices took %v despite 200ms timeout", elapsed)
+	}
+	if len(ss) != 4 {
+		t.Errorf("Expected the 4 services from responsive registries, got %v", ss)
+	}
+}
+
+func TestListServicesNoGoroutineLeak(t *testing.T) {
+	defer startSlowPeer(t, "127.0.0.11")()
+	// Warm up connections to the responsive registries so they don't count
+	// against the baseline.
+	opts := QueryOptions{Timeout: 200 * time.Millisecond}
+	if _, err := ListServicesWithOptions(opts); err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	transport.CloseIdleConnections()
+	time.Sleep(50 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	if _, err := ListServicesWithOptions(opts); err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		transport.CloseIdleConnections()
+		n := runtime.NumGoroutine()
+		if n <= baseline {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Goroutine count is %d, expected at most %d", n, baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListServicesFrom(t *testing.T) {
+	ss, err := ListServicesFrom([]netip.Addr{netip.MustParseAddr("127.0.0.3")})
+	if err != nil {
+		t.Fatalf("ListServicesFrom failed: %v", err)
+	}
+	if len(ss) != 1 || ss[0].Name != "bar" {
+		t.Errorf("Expected only bar, got %v", ss)
+	}
+
+	// With a hint, FindService doesn't see services on other hosts.
+	opts := QueryOptions{Hosts: []netip.Addr{netip.MustParseAddr("127.0.0.4")}}
+	if _, err := FindServiceWithOptions("bar", nil, opts); !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("Expected ErrServiceNotFound for bar, got %v", err)
+	}
+	ap, err := FindServiceWithOptions("baz", nil, opts)
+	if err != nil {
+		t.Fatalf("FindService failed: %v", err)
+	}
+	if want := netip.MustParseAddrPort("127.0.0.4:42"); ap != want {
+		t.Errorf("Expected %v, got %v", want, ap)
+	}
+}
+
+func TestListServicesConcurrency(t *testing.T) {
+	defer startSlowPeer(t, "127.0.0.12")()
+	defer startSlowPeer(t, "127.0.0.13")()
+	timeout := 200 * time.Millisecond
+
+	// By default, both slow peers time out in parallel.
+	start := time.Now()
+	if _, err := ListServicesWithOptions(QueryOptions{Timeout: timeout}); err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 2*timeout {
+		t.Errorf("Parallel ListServices took %v", elapsed)
+	}
+
+	// With a single worker, the slow peers time out one after the other, and
+	// the responsive registries still get their turn.
+	start = time.Now()
+	ss, err := ListServicesWithOptions(QueryOptions{Timeout: timeout, Concurrency: 1})
+	if err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 3*timeout {
+		t.Errorf("Sequential ListServices took %v", elapsed)
+	}
+	if len(ss) != 4 {
+		t.Errorf("Expected the 4 services from responsive registries, got %v", ss)
+	}
+}
+
+func TestListServicesQueuedBehindHung(t *testing.T) {
+	defer startSlowPeer(t, "127.0.0.12")()
+	defer startSlowPeer(t, "127.0.0.13")()
+	defer startSlowPeer(t, "127.0.0.29")()
+	// More hung peers than workers, with the healthy one queued last.
+	addrs := []netip.Addr{
+		netip.MustParseAddr("127.0.0.12"),
+		netip.MustParseAddr("127.0.0.13"),
+		netip.MustParseAddr("127.0.0.29"),
+		netip.MustParseAddr("127.0.0.3"),
+	}
+	opts := QueryOptions{Timeout: 200 * time.Millisecond, Concurrency: 2}
+	ss, err := listServicesFrom(context.Background(), addrs, opts)
+	if err != nil {
+		t.Fatalf("listServicesFrom failed: %v", err)
+	}
+	if !slices.ContainsFunc(ss, func(s Service) bool { return s.Name == "bar" }) {
+		t.Errorf("Expected services of the healthy peer, got %v", ss)
+	}
+}
+
+func TestRefusedPeerCooldown(t *testing.T) {
+	// Nothing listens on this peer.
+	peer := netip.MustParseAddr("127.0.0.14")
+	refused := netip.AddrPortFrom(peer, DefaultPort)
+	oldPeers := fakeTailnetMap.PeerAddrs
+	fakeTailnetMap.PeerAddrs = append(slices.Clone(oldPeers), peer)
+	defer func() { fakeTailnetMap.PeerAddrs = oldPeers }()
+	defer func() {
+		refusedMutex.Lock()
+		delete(refusedUntil, refused)
+		refusedMutex.Unlock()
+	}()
+
+	var mu sync.Mutex
+	var dialed []string
+	SetDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})
+	defer SetDialer((&net.Dialer{}).DialContext)
+	wasDialed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		found := slices.Contains(dialed, "127.0.0.14:28004")
+		dialed = nil
+		return found
+	}
+
+	if _, err := ListServices(); err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	if !wasDialed() || !recentlyRefused(refused) {
+		t.Fatalf("Expected %v to be queried and marked as refused", refused)
+	}
+	if recentlyRefused(netip.AddrPortFrom(peer, DefaultPort+10)) {
+		t.Errorf("Expected other ports of %v to stay unaffected", peer)
+	}
+	if _, err := ListServices(); err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	if wasDialed() {
+		t.Errorf("Refused peer %v was queried again during cooldown", refused)
+	}
+
+	// Once the cooldown is over, the peer gets probed again.
+	refusedMutex.Lock()
+	refusedUntil[refused] = time.Now().Add(-time.Second)
+	refusedMutex.Unlock()
+	if _, err := ListServices(); err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	if !wasDialed() {
+		t.Errorf("Refused peer %v wasn't probed after cooldown", refused)
+	}
+}
+
+func TestUpstreams(t *testing.T) {
+	r := newTestRegistry()
+	r.addr = netip.MustParseAddrPort("127.0.0.2:28004")
+	if err := r.AddUpstream(r.addr); err == nil {
+		t.Error("Expected error when adding registry as its own upstream")
+	}
+	upstream := netip.MustParseAddrPort("127.0.0.3:28004")
+	for range 2 {
+		if err := r.AddUpstream(upstream); err != nil {
+			t.Fatalf("AddUpstream failed: %v", err)
+		}
+	}
+	if !reflect.DeepEqual(r.upstreams, []netip.AddrPort{upstream}) {
+		t.Errorf("Expected upstreams [%v], got %v", upstream, r.upstreams)
+	}
+
+	req := httptest.NewRequest("GET", "/services", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	ss, err := decodeServices(rec.Body.Bytes(), ProtocolVersion)
+	if err != nil {
+		t.Fatalf("Error decoding services: %v", err)
+	}
+	if len(ss) != 1 || ss[0].Name != "bar" || ss[0].Source != upstream {
+		t.Errorf("Expected bar from upstream %v, got %v", upstream, ss)
+	}
+
+	// Requests that already passed through the registry are aborted.
+	req.Header.Set(pathHeader, "127.0.0.9:28004, "+r.addr.String())
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusLoopDetected {
+		t.Errorf("Expected 508 Loop Detected, got %d", rec.Code)
+	}
+}
+
+func TestUpstreamCycle(t *testing.T) {
+	// Two registries that are each other's upstream.
+	var registries []*Registry
+	for i, addr := range []string{"127.0.0.15", "127.0.0.16"} {
+		r := newTestRegistry()
+		r.localAddr = netip.MustParseAddr(addr)
+		r.addr = netip.AddrPortFrom(r.localAddr, 28004)
+		name := fmt.Sprintf("svc%d", i)
+		if err := r.AdvertiseService(42, name, nil); err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", r.addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewUnstartedServer(r)
+		srv.Listener = ln
+		srv.Start()
+		defer srv.Close()
+		registries = append(registries, r)
+	}
+	a, b := registries[0], registries[1]
+	if err := a.AddUpstream(b.addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddUpstream(a.addr); err != nil {
+		t.Fatal(err)
+	}
+
+	ss, err := getRemoteServices(context.Background(), a.addr, "", DefaultQueryTimeout)
+	if err != nil {
+		t.Fatalf("getRemoteServices failed: %v", err)
+	}
+	var names []string
+	for _, s := range ss {
+		names = append(names, s.Name)
+	}
+	if want := []string{"svc0", "svc1"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected %v, got %v", want, names)
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	path := []netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.2:28004"),
+		netip.MustParseAddrPort("127.0.0.3:28004"),
+	}
+	if got := parsePath(formatPath(path)); !reflect.DeepEqual(got, path) {
+		t.Errorf("Expected %v, got %v", path, got)
+	}
+	if got := parsePath("127.0.0.2:28004, bogus,"); !reflect.DeepEqual(got, path[:1]) {
+		t.Errorf("Expected %v, got %v", path[:1], got)
+	}
+	if got := parsePath(""); len(got) != 0 {
+		t.Errorf("Expected empty path, got %v", got)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	type entry struct {
+		method, path, remote string
+		status               int
+	}
+	var entries []entry
+	r := newTestRegistry()
+	r.accessLog = func(req *http.Request, status int, dur time.Duration) {
+		if dur < 0 {
+			t.Errorf("Negative duration %v", dur)
+		}
+		entries = append(entries, entry{req.Method, req.URL.Path, req.RemoteAddr, status})
+	}
+	for _, c := range []struct{ method, path string }{
+		{"GET", "/services"},
+		{"POST", "/add-delegate"},
+		{"GET", "/nope"},
+	} {
+		req := httptest.NewRequest(c.method, c.path, strings.NewReader("{}"))
+		req.RemoteAddr = "100.64.0.1:1234"
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	expected := []entry{
+		{"GET", "/services", "100.64.0.1:1234", http.StatusOK},
+		{"POST", "/add-delegate", "100.64.0.1:1234", http.StatusForbidden},
+		{"GET", "/nope", "100.64.0.1:1234", http.StatusNotFound},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected %v, got %v", expected, entries)
+	}
+}
+
+func TestServiceEqual(t *testing.T) {
+	now := time.Now()
+	base := Service{
+		Name:         "svc",
+		Labels:       map[string]string{"env": "prod"},
+		AddrPort:     netip.MustParseAddrPort("100.64.0.1:80"),
+		Target:       "tcp://100.64.0.1:80",
+		RegisteredAt: now,
+	}
+	same := base
+	same.Labels = map[string]string{"env": "prod"}
+	same.Annotations = map[string]string{}
+	same.RegisteredAt = now.UTC()
+	if !base.Equal(same) {
+		t.Errorf("Expected %v to equal %v", base, same)
+	}
+	if !(Service{Name: "svc"}).Equal(Service{Name: "svc", Labels: map[string]string{}}) {
+		t.Error("Expected nil and empty labels to be equal")
+	}
+
+	changes := []func(s *Service){
+		func(s *Service) { s.Name = "other" },
+		func(s *Service) { s.Labels = map[string]string{"env": "dev"} },
+		func(s *Service) { s.AddrPort = netip.MustParseAddrPort("100.64.0.1:81") },
+		func(s *Service) { s.Scheme = "http" },
+		func(s *Service) { s.Annotations = map[string]string{"v": "1"} },
+		func(s *Service) { s.RegisteredAt = now.Add(time.Second) },
+		func(s *Service) { s.Source = netip.MustParseAddrPort("100.64.0.1:28004") },
+	}
+	for i, change := range changes {
+		other := base
+		change(&other)
+		if base.Equal(other) {
+			t.Errorf("Change %d: expected %v to differ from %v", i, other, base)
+		}
+	}
+}
+
+func TestNormalizeService(t *testing.T) {
+	s := NormalizeService(Service{
+		Name:     "svc",
+		AddrPort: netip.MustParseAddrPort("100.64.0.1:80"),
+	})
+	if s.Labels == nil {
+		t.Error("Expected non-nil labels")
+	}
+	if s.Target != "tcp://100.64.0.1:80" {
+		t.Errorf("Expected target derived from address, got %q", s.Target)
+	}
+	unix := NormalizeService(Service{Name: "svc", Target: "unix:///run/svc.sock"})
+	if unix.Target != "unix:///run/svc.sock" || unix.AddrPort.IsValid() {
+		t.Errorf("Unix service changed: %v", unix)
+	}
+}
+
+func TestUnmarshalMissingLabels(t *testing.T) {
+	payloads := []string{
+		`[{"name":"svc","addrPort":"100.64.0.1:80"}]`,
+		`[{"name":"svc","labels":null,"addrPort":"100.64.0.1:80"}]`,
+	}
+	for _, p := range payloads {
+		ss, err := decodeServices([]byte(p), ProtocolVersion)
+		if err != nil {
+			t.Fatalf("Error decoding %s: %v", p, err)
+		}
+		if len(ss) != 1 || ss[0].Labels == nil {
+			t.Errorf("Expected non-nil labels decoding %s, got %v", p, ss)
+		}
+		if ss[0].Target != "tcp://100.64.0.1:80" {
+			t.Errorf("Expected target derived from address, got %q", ss[0].Target)
+		}
+	}
+	var s Service
+	if err := json.Unmarshal([]byte(`{"name": 42}`), &s); err == nil {
+		t.Error("Expected error for malformed service")
+	}
+}
+
+func TestServiceJSON(t *testing.T) {
+	full := Service{
+		Name:         "svc",
+		Aliases:      []string{"alias"},
+		Labels:       map[string]string{"env": "prod", "region": "eu"},
+		AddrPort:     netip.MustParseAddrPort("100.64.0.1:80"),
+		Target:       "tcp://100.64.0.1:80",
+		Scheme:       "grpc",
+		GRPCConfig:   `{"loadBalancingConfig": [{"round_robin": {}}]}`,
+		Annotations:  map[string]string{"description": "A service"},
+		RegisteredAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Source:       netip.MustParseAddrPort("100.64.0.1:28004"),
+	}
+	cases := []struct {
+		title   string
+		service Service
+		golden  string
+	}{
+		{
+			"full", full,
+			`{"name":"svc","aliases":["alias"],"labels":{"env":"prod","region":"eu"},` +
+				`"addrPort":"100.64.0.1:80","target":"tcp://100.64.0.1:80","scheme":"grpc",` +
+				`"grpcConfig":"{\"loadBalancingConfig\": [{\"round_robin\": {}}]}",` +
+				`"annotations":{"description":"A service"},"registeredAt":"2024-01-02T03:04:05Z",` +
+				`"source":"100.64.0.1:28004"}`,
+		},
+		{
+			"empty", Service{},
+			`{"name":"","labels":{},"addrPort":"","annotations":{},` +
+				`"registeredAt":"0001-01-01T00:00:00Z","source":""}`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			data, err := json.Marshal(c.service)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != c.golden {
+				t.Errorf("Expected JSON\n%s\ngot\n%s", c.golden, data)
+			}
+			var decoded Service
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if want := NormalizeService(c.service); !decoded.Equal(want) {
+				t.Errorf("Expected %v after round trip, got %v", want, decoded)
+			}
+		})
+	}
+}
+
+func TestDecodeInvalidServices(t *testing.T) {
+	data := `[
+		{"name":"tcp","addrPort":"100.64.0.1:80"},
+		{"name":"unix","target":"unix:///run/svc.sock"},
+		{"name":"","addrPort":"100.64.0.1:81"},
+		{"name":"zero"},
+		{"name":"port0","addrPort":"100.64.0.1:0"},
+		{"name":"relative","target":"unix://svc.sock"},
+		{"name":"other","target":"udp://100.64.0.1:53"}
+	]`
+	ss, err := decodeServices([]byte(data), ProtocolVersion)
+	if err != nil {
+		t.Fatalf("Error decoding services: %v", err)
+	}
+	var names []string
+	for _, s := range ss {
+		names = append(names, s.Name)
+	}
+	if want := []string{"tcp", "unix"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected %v, got %v", want, names)
+	}
+
+	// Version 1 has no services without a TCP address.
+	ss, err = decodeServices([]byte(data), 1)
+	if err != nil {
+		t.Fatalf("Error decoding services: %v", err)
+	}
+	if len(ss) != 1 || ss[0].Name != "tcp" {
+		t.Errorf("Expected only tcp in version 1, got %v", ss)
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	var services []Service
+	for i := range 100 {
+		services = append(services, Service{
+			Name:     fmt.Sprintf("svc%d", i),
+			AddrPort: netip.AddrPortFrom(netip.MustParseAddr("100.64.0.1"), uint16(1000+i)),
+		})
+	}
+	data, err := json.Marshal(services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		wrt.Write(data)
+	}))
+	defer srv.Close()
+	ap := netip.MustParseAddrPort(srv.Listener.Addr().String())
+
+	SetMaxResponseSize(int64(len(data)) - 1)
+	defer SetMaxResponseSize(DefaultMaxResponseSize)
+	if _, err := getRemoteServices(context.Background(), ap, "", DefaultQueryTimeout); err == nil {
+		t.Error("Expected error for oversized response")
+	}
+	SetMaxResponseSize(int64(len(data)))
+	ss, err := getRemoteServices(context.Background(), ap, "", DefaultQueryTimeout)
+	if err != nil || len(ss) != len(services) {
+		t.Errorf("Expected %d services, got %d, error %v", len(services), len(ss), err)
+	}
+}
+
+func TestRemoveDelegateOrigin(t *testing.T) {
+	r := newTestRegistry()
+	d := netip.MustParseAddrPort("127.0.0.2:40001")
+	r.delegates = []netip.AddrPort{d}
+	body := `{"addrPort":"127.0.0.2:40001"}`
+
+	req := httptest.NewRequest("POST", "/remove-delegate", strings.NewReader(body))
+	req.RemoteAddr = "127.0.0.3:50000"
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || len(r.delegates) != 1 {
+		t.Errorf("Expected remote request to be rejected, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/remove-delegate", strings.NewReader(body))
+	req.RemoteAddr = "127.0.0.2:50000"
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || len(r.delegates) != 0 {
+		t.Errorf("Expected local request to remove the delegate, got %d", rec.Code)
+	}
+}
+
+func TestMaxRequestSize(t *testing.T) {
+	r := newTestRegistry()
+	for _, path := range []string{"/add-delegate", "/remove-delegate"} {
+		body := `{"addrPort":"` + strings.Repeat("1", maxRequestSize) + `"}`
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: expected status 413, got %d", path, rec.Code)
+		}
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	srv := newTestRegistry().newServer()
+	timeouts := []time.Duration{
+		srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout,
+	}
+	if slices.Min(timeouts) <= 0 {
+		t.Errorf("Expected all server timeouts to be set: %+v", srv)
+	}
+	if srv.MaxHeaderBytes <= 0 || srv.MaxHeaderBytes >= http.DefaultMaxHeaderBytes {
+		t.Errorf("Expected header limit below default, got %d", srv.MaxHeaderBytes)
+	}
+
+	// Oversized headers are rejected.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	req, err := http.NewRequest("GET", "http://"+ln.Addr().String()+"/ping", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Padding", strings.Repeat("x", 2*serverMaxHeaderBytes))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected status 431, got %d", resp.StatusCode)
+	}
+}
+
+func TestRegistryAddr(t *testing.T) {
+	if want := netip.MustParseAddrPort("127.0.0.2:28004"); registry.Addr() != want {
+		t.Errorf("Expected leader at %v, got %v", want, registry.Addr())
+	}
+	addr := delegate.Addr()
+	if addr.Addr() != registry.localAddr || addr.Port() == 0 || addr.Port() == 28004 {
+		t.Errorf("Expected delegate on an ephemeral port, got %v", addr)
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if !slices.Contains(registry.delegates, addr) {
+		t.Errorf("Delegate %v not registered with leader: %v", addr, registry.delegates)
+	}
+}
+
+func TestDelegatePortRange(t *testing.T) {
+	for _, bad := range [][2]uint16{{0, 28010}, {28010, 28005}} {
+		opts := StartRegistryOptions{DelegatePortRange: bad}
+		if r, err := StartRegistryWithOptions(opts); err == nil {
+			r.Close()
+			t.Errorf("Expected error for delegate port range %v", bad)
+		}
+	}
+
+	// The global leader doesn't share the range, so it rejects the delegate.
+	opts := StartRegistryOptions{DelegatePortRange: [2]uint16{28005, 28010}}
+	if err := registry.validateDelegate(netip.MustParseAddrPort("127.0.0.2:28005")); err == nil {
+		t.Errorf("Expected leader without range to reject delegate on port 28005")
+	}
+	// A leader with the same range accepts it.
+	oldAddr := fakeTailnetMap.LocalAddr
+	fakeTailnetMap.LocalAddr = netip.MustParseAddr("127.0.0.27")
+	defer func() { fakeTailnetMap.LocalAddr = oldAddr }()
+	leader, err := StartRegistryWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	r, err := StartRegistryWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Role() != RoleDelegate {
+		t.Fatalf("Expected delegate role, got %v", r.Role())
+	}
+	if port := r.Addr().Port(); port < 28005 || port > 28010 {
+		t.Errorf("Expected delegate port in 28005-28010, got %d", port)
+	}
+	leader.mutex.Lock()
+	registered := slices.Contains(leader.delegates, r.Addr())
+	leader.mutex.Unlock()
+	if !registered {
+		t.Errorf("Delegate at %v not registered with leader", r.Addr())
+	}
+
+	// With the range taken, it depends on StrictDelegatePorts whether the
+	// registry falls back to any port.
+	ln, err := net.Listen("tcp4", "127.0.0.27:28011")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	opts = StartRegistryOptions{DelegatePortRange: [2]uint16{28011, 28011}}
+	fallback, err := StartRegistryWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fallback.Close()
+	if fallback.Addr().Port() == 28011 {
+		t.Errorf("Expected fallback to another port, got %v", fallback.Addr())
+	}
+	opts.StrictDelegatePorts = true
+	if strict, err := StartRegistryWithOptions(opts); err == nil {
+		strict.Close()
+		t.Error("Expected error with all delegate ports taken")
+	}
+}
+
+func TestOnRoleChange(t *testing.T) {
+	oldAddr := fakeTailnetMap.LocalAddr
+	fakeTailnetMap.LocalAddr = netip.MustParseAddr("127.0.0.17")
+	defer func() { fakeTailnetMap.LocalAddr = oldAddr }()
+	leader, err := StartRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+
+	roles := make(chan Role, 10)
+	// The first callback comes before StartRegistry returns.
+	var started atomic.Pointer[Registry]
+	r, err := StartRegistryWithOptions(StartRegistryOptions{
+		WatchdogInterval: 100 * time.Millisecond,
+		OnRoleChange: func(role Role) {
+			// Calling back into the registry must not deadlock.
+			if r := started.Load(); r != nil && r.Role() != role {
+				t.Errorf("Callback for %v, but registry is %v", role, r.Role())
+			}
+			roles <- role
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	started.Store(r)
+	expect := func(want Role) {
+		select {
+		case got := <-roles:
+			if got != want {
+				t.Errorf("Expected role change to %v, got %v", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No role change to %v", want)
+		}
+	}
+	expect(RoleDelegate)
+	// When the leader goes away, the delegate takes over.
+	leader.Close()
+	expect(RoleConnecting)
+	expect(RoleLeader)
+}
+
+func TestLookupByAddr(t *testing.T) {
+	ss, err := LookupByAddr(netip.MustParseAddrPort("127.0.0.3:42"))
+	if err != nil {
+		t.Fatalf("LookupByAddr failed: %v", err)
+	}
+	if len(ss) != 1 || ss[0].Name != "bar" {
+		t.Errorf("Expected bar, got %v", ss)
+	}
+	_, err = LookupByAddr(netip.MustParseAddrPort("127.0.0.3:43"))
+	if !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("Expected ErrServiceNotFound, got %v", err)
+	}
+}
+
+func TestLookupByHost(t *testing.T) {
+	ss, err := LookupByHost(netip.MustParseAddr("127.0.0.2"))
+	if err != nil {
+		t.Fatalf("LookupByHost failed: %v", err)
+	}
+	var names []string
+	for _, s := range ss {
+		names = append(names, s.Name)
+	}
+	slices.Sort(names)
+	if want := []string{"foo", "oof"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected %v, got %v", want, names)
+	}
+	_, err = LookupByHost(netip.MustParseAddr("127.0.0.99"))
+	if !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("Expected ErrServiceNotFound, got %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	if _, err := Ping(netip.MustParseAddrPort("127.0.0.2:28004")); err != nil {
+		t.Errorf("Ping to leader failed: %v", err)
+	}
+	// The fake peers answer, but aren't real registries.
+	if _, err := Ping(netip.MustParseAddrPort("127.0.0.3:28004")); err == nil {
+		t.Error("Expected error pinging fake registry")
+	}
+	if _, err := Ping(netip.MustParseAddrPort("127.0.0.99:28004")); err == nil {
+		t.Error("Expected error pinging missing registry")
+	}
+}
+
+func TestCurrentTailnet(t *testing.T) {
+	tmap, err := CurrentTailnet()
+	if err != nil {
+		t.Fatalf("CurrentTailnet failed: %v", err)
+	}
+	if tmap.LocalAddr != fakeTailnetMap.LocalAddr {
+		t.Errorf("Expected local address %v, got %v", fakeTailnetMap.LocalAddr, tmap.LocalAddr)
+	}
+	SetStatusProvider(SocketStatusProvider{Path: "/nonexistent/tailscaled.sock"})
+	defer SetStatusProvider(fakeStatusProvider{})
+	if _, err := CurrentTailnet(); !errors.Is(err, ErrTailnetUnavailable) {
+		t.Errorf("Expected ErrTailnetUnavailable, got %v", err)
+	}
+}
+
+// startFakeTailscaled serves status as the Tailnet status on a Unix socket, and
+// returns its path.
+func startFakeTailscaled(t *testing.T, status string) string {
+	path := filepath.Join(t.TempDir(), "tailscaled.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(wrt http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/localapi/v0/status" {
+				http.NotFound(wrt, req)
+				return
+			}
+			io.WriteString(wrt, status)
+		},
+	))
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return path
+}
+
+// warningLogger records warnings.
+type warningLogger struct {
+	noopLogger
+	mutex    sync.Mutex
+	warnings []string
+}
+
+func (l *warningLogger) Warnf(format string, args ...any) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func TestWarnNoIPv4(t *testing.T) {
+	path := startFakeTailscaled(t, `{
+		"TailscaleIPs": ["100.64.0.1"],
+		"Self": {"DNSName": "self.ts.net.", "Online": true, "TailscaleIPs": ["100.64.0.1"]},
+		"Peer": {
+			"a": {"DNSName": "v4.ts.net.", "Online": true, "TailscaleIPs": ["100.64.0.2"]},
+			"b": {"DNSName": "v6only.ts.net.", "Online": true, "TailscaleIPs": ["fd7a:115c:a1e0::3"]},
+			"c": {"DNSName": "v6off.ts.net.", "Online": false, "TailscaleIPs": ["fd7a:115c:a1e0::4"]}
+		}
+	}`)
+	l := &warningLogger{}
+	oldLogger := GetLogger()
+	SetLogger(l)
+	defer SetLogger(oldLogger)
+
+	for range 2 {
+		tmap, err := SocketStatusProvider{Path: path}.TailnetMap()
+		if err != nil {
+			t.Fatalf("TailnetMap failed: %v", err)
+		}
+		want := []netip.Addr{netip.MustParseAddr("100.64.0.2")}
+		if !reflect.DeepEqual(tmap.PeerAddrs, want) {
+			t.Errorf("Expected peers %v, got %v", want, tmap.PeerAddrs)
+		}
+	}
+	// Only one warning for the online peer, despite two status updates.
+	if len(l.warnings) != 1 || !strings.Contains(l.warnings[0], "v6only.ts.net") {
+		t.Errorf("Expected one warning about v6only.ts.net, got %q", l.warnings)
+	}
+}
+
+// flakyStatusProvider fails a number of times before returning the fake map.
+type flakyStatusProvider struct {
+	failures atomic.Int32
+}
+
+func (p *flakyStatusProvider) TailnetMap() (TailnetMap, error) {
+	if p.failures.Add(-1) >= 0 {
+		return TailnetMap{}, errors.New("tailscaled not running")
+	}
+	return fakeStatusProvider{}.TailnetMap()
+}
+
+func TestHealthCheck(t *testing.T) {
+	oldAddr := fakeTailnetMap.LocalAddr
+	fakeTailnetMap.LocalAddr = netip.MustParseAddr("127.0.0.24")
+	defer func() { fakeTailnetMap.LocalAddr = oldAddr }()
+	p := &flakyStatusProvider{}
+	r, err := StartRegistryWithOptions(StartRegistryOptions{StatusProvider: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := r.HealthCheck(ctx); err != nil {
+		t.Errorf("Expected healthy registry, got %v", err)
+	}
+	if err := HealthCheck(ctx); err != nil {
+		t.Errorf("Expected healthy process, got %v", err)
+	}
+
+	p.failures.Store(1)
+	if err := r.HealthCheck(ctx); !errors.Is(err, ErrTailnetUnavailable) {
+		t.Errorf("Expected ErrTailnetUnavailable, got %v", err)
+	}
+
+	r.Close()
+	if err := r.HealthCheck(ctx); !errors.Is(err, ErrRegistryClosed) {
+		t.Errorf("Expected ErrRegistryClosed, got %v", err)
+	}
+	if slices.Contains(runningRegistries(), r) {
+		t.Errorf("Expected closed registry to be skipped by HealthCheck")
+	}
+}
+
+func TestStartRegistryContext(t *testing.T) {
+	// Cancelling the context stops a delegate, which deregisters from the
+	// leader.
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := StartRegistryContext(ctx, StartRegistryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Role() != RoleDelegate {
+		t.Fatalf("Expected delegate role, got %v", r.Role())
+	}
+	cancel()
+	select {
+	case <-r.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Registry didn't stop after cancel")
+	}
+	registry.mutex.Lock()
+	registered := slices.Contains(registry.delegates, r.Addr())
+	registry.mutex.Unlock()
+	if registered {
+		t.Errorf("Expected delegate %v to deregister", r.Addr())
+	}
+	if err := r.Close(); !errors.Is(err, ErrRegistryClosed) {
+		t.Errorf("Expected ErrRegistryClosed, got %v", err)
+	}
+
+	// A context that ends while waiting for Tailscale aborts the start.
+	p := &flakyStatusProvider{}
+	p.failures.Store(1000)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = StartRegistryContext(ctx, StartRegistryOptions{
+		StatusProvider:   p,
+		WaitForTailscale: time.Minute,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestAdvertiseServiceChecked(t *testing.T) {
+	r := newTestRegistry()
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := netip.MustParseAddrPort(ln.Addr().String()).Port()
+	if err := r.AdvertiseServiceChecked(port, "listening", nil); err != nil {
+		t.Errorf("Expected listening service to be advertised, got %v", err)
+	}
+	ln.Close()
+	if err := r.AdvertiseServiceChecked(port, "gone", nil); err == nil {
+		t.Errorf("Expected error for port without listener")
+	}
+	var names []string
+	for _, s := range r.LocalServices() {
+		names = append(names, s.Name)
+	}
+	if !slices.Equal(names, []string{"listening"}) {
+		t.Errorf("Expected only listening service, got %v", names)
+	}
+}
+
+func TestFindServiceWait(t *testing.T) {
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		registry.AdvertiseService(4104, "late", nil)
+	}()
+	defer registry.UnlistService(4104)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ap, err := FindServiceWait(ctx, "late", nil)
+	if want := netip.MustParseAddrPort("127.0.0.2:4104"); err != nil || ap != want {
+		t.Errorf("Expected %v, got %v, %v", want, ap, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = FindServiceWait(ctx, "never", nil)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("Expected deadline and ErrServiceNotFound, got %v", err)
+	}
+}
+
+func TestFindServicesMin(t *testing.T) {
+	if err := registry.AdvertiseService(4105, "replica", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.UnlistService(4105)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		registry.AdvertiseService(4106, "replica", nil)
+	}()
+	defer registry.UnlistService(4106)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ss, err := FindServicesMin(ctx, "replica", nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 2 || ss[0].AddrPort.Port() != 4105 || ss[1].AddrPort.Port() != 4106 {
+		t.Errorf("Expected both replicas, got %v", ss)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = FindServicesMin(ctx, "replica", nil, 3)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("Expected deadline and ErrServiceNotFound, got %v", err)
+	}
+}
+
+func TestWaitForTailscale(t *testing.T) {
+	oldAddr := fakeTailnetMap.LocalAddr
+	fakeTailnetMap.LocalAddr = netip.MustParseAddr("127.0.0.18")
+	defer func() { fakeTailnetMap.LocalAddr = oldAddr }()
+
+	p := &flakyStatusProvider{}
+	p.failures.Store(2)
+	_, err := StartRegistryWithOptions(StartRegistryOptions{StatusProvider: p})
+	if !errors.Is(err, ErrTailnetUnavailable) {
+		t.Errorf("Expected ErrTailnetUnavailable without waiting, got %v", err)
+	}
+
+	r, err := StartRegistryWithOptions(StartRegistryOptions{
+		StatusProvider:   p,
+		WaitForTailscale: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("StartRegistry failed despite waiting: %v", err)
+	}
+	defer r.Close()
+	if r.Role() != RoleLeader {
+		t.Errorf("Expected leader role, got %v", r.Role())
+	}
+
+	p.failures.Store(100)
+	start := time.Now()
+	_, err = StartRegistryWithOptions(StartRegistryOptions{
+		StatusProvider:   p,
+		WaitForTailscale: 300 * time.Millisecond,
+	})
+	if !errors.Is(err, ErrTailnetUnavailable) {
+		t.Errorf("Expected ErrTailnetUnavailable after waiting, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected to wait about 300ms, waited %v", elapsed)
+	}
+}
+
+func TestPeerTags(t *testing.T) {
+	path := startFakeTailscaled(t, `{
+		"TailscaleIPs": ["100.64.0.1"],
+		"Self": {"DNSName": "self.ts.net.", "Online": true, "TailscaleIPs": ["100.64.0.1"], "Tags": ["tag:server"]},
+		"Peer": {
+			"a": {"DNSName": "server.ts.net.", "Online": true, "TailscaleIPs": ["100.64.0.2"], "Tags": ["tag:server", "tag:prod"]},
+			"b": {"DNSName": "laptop.ts.net.", "Online": true, "TailscaleIPs": ["100.64.0.3"]}
+		}
+	}`)
+	tmap, err := SocketStatusProvider{Path: path}.TailnetMap()
+	if err != nil {
+		t.Fatalf("TailnetMap failed: %v", err)
+	}
+	want := map[netip.Addr][]string{
+		netip.MustParseAddr("100.64.0.1"): {"tag:server"},
+		netip.MustParseAddr("100.64.0.2"): {"tag:server", "tag:prod"},
+	}
+	if !reflect.DeepEqual(tmap.Tags, want) {
+		t.Errorf("Expected tags %v, got %v", want, tmap.Tags)
+	}
+
+	fakeTailnetMap.Tags = map[netip.Addr][]string{
+		netip.MustParseAddr("127.0.0.3"): {"tag:server"},
+		netip.MustParseAddr("127.0.0.4"): {"tag:laptop"},
+	}
+	defer func() { fakeTailnetMap.Tags = nil }()
+	ss, err := ListServicesWithOptions(QueryOptions{PeerTags: []string{"tag:prod", "tag:server"}})
+	if err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	var names []string
+	for _, s := range ss {
+		names = append(names, s.Name)
+	}
+	slices.Sort(names)
+	if expected := []string{"bar", "foo", "oof"}; !slices.Equal(names, expected) {
+		t.Errorf("Expected services %v, got %v", expected, names)
+	}
+}
+
+func TestLocalAddrIgnoresSubnetRoutes(t *testing.T) {
+	path := startFakeTailscaled(t, `{
+		"TailscaleIPs": ["192.168.1.1", "100.101.102.103", "fd7a:115c:a1e0::1"],
+		"Self": {
+			"DNSName": "router.ts.net.", "Online": true,
+			"TailscaleIPs": ["192.168.1.1", "100.101.102.103", "fd7a:115c:a1e0::1"],
+			"PrimaryRoutes": ["192.168.1.0/24"]
+		},
+		"Peer": {
+			"a": {
+				"DNSName": "exit.ts.net.", "Online": true,
+				"TailscaleIPs": ["10.0.0.1", "100.64.0.2"],
+				"PrimaryRoutes": ["10.0.0.0/8"]
+			}
+		}
+	}`)
+	tmap, err := SocketStatusProvider{Path: path}.TailnetMap()
+	if err != nil {
+		t.Fatalf("TailnetMap failed: %v", err)
+	}
+	if want := netip.MustParseAddr("100.101.102.103"); tmap.LocalAddr != want {
+		t.Errorf("Expected local address %v, got %v", want, tmap.LocalAddr)
+	}
+	want := []netip.Addr{netip.MustParseAddr("100.64.0.2")}
+	if !reflect.DeepEqual(tmap.PeerAddrs, want) {
+		t.Errorf("Expected peers %v, got %v", want, tmap.PeerAddrs)
+	}
+}
+
+func TestFindIPv4Addr(t *testing.T) {
+	routes := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	for _, tc := range []struct {
+		addrs []string
+		want  string
+	}{
+		{[]string{"10.1.2.3", "100.64.0.1"}, "100.64.0.1"},
+		{[]string{"172.16.0.1", "100.64.0.1"}, "100.64.0.1"},
+		{[]string{"fd7a:115c:a1e0::1", "172.16.0.1"}, "172.16.0.1"},
+		{[]string{"10.1.2.3", "fd7a:115c:a1e0::1"}, ""},
+	} {
+		var addrs []netip.Addr
+		for _, a := range tc.addrs {
+			addrs = append(addrs, netip.MustParseAddr(a))
+		}
+		got, ok := findIPv4Addr(addrs, routes)
+		if tc.want == "" {
+			if ok {
+				t.Errorf("findIPv4Addr(%v): expected nothing, got %v", tc.addrs, got)
+			}
+		} else if !ok || got != netip.MustParseAddr(tc.want) {
+			t.Errorf("findIPv4Addr(%v) = %v, %v; want %v", tc.addrs, got, ok, tc.want)
+		}
+	}
+}
+
+func TestCompareServices(t *testing.T) {
+	ss := []Service{
+		{Name: "b", AddrPort: netip.MustParseAddrPort("100.64.0.1:80")},
+		{Name: "a", Target: "unix:///run/b.sock"},
+		{Name: "a", AddrPort: netip.MustParseAddrPort("100.64.0.2:80")},
+		{Name: "a", Target: "unix:///run/a.sock"},
+		{Name: "a", AddrPort: netip.MustParseAddrPort("100.64.0.1:8080")},
+		{Name: "a", AddrPort: netip.MustParseAddrPort("100.64.0.1:80")},
+	}
+	slices.SortFunc(ss, CompareServices)
+	var got []string
+	for _, s := range ss {
+		got = append(got, s.Name+" "+s.AddrPort.String()+" "+s.Target)
+	}
+	want := []string{
+		"a invalid AddrPort unix:///run/a.sock",
+		"a invalid AddrPort unix:///run/b.sock",
+		"a 100.64.0.1:80 ",
+		"a 100.64.0.1:8080 ",
+		"a 100.64.0.2:80 ",
+		"b 100.64.0.1:80 ",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Wrong order.\nExpected: %q\nActual: %q", want, got)
+	}
+}
+
+func TestUpdateAndUnlistByName(t *testing.T) {
+	r := newTestRegistry()
+	r.AdvertiseService(1001, "web", map[string]string{"env": "dev"})
+	r.AdvertiseService(1002, "web", map[string]string{"env": "dev"})
+	r.AdvertiseService(1003, "db", nil)
+	before := r.LocalServices()
+
+	if err := r.UpdateServiceLabels("web", map[string]string{"env": "prod"}); err != nil {
+		t.Fatalf("UpdateServiceLabels failed: %v", err)
+	}
+	ss := r.LocalServices()
+	for i, s := range ss[:2] {
+		if s.Labels["env"] != "prod" {
+			t.Errorf("Expected env=prod for %v, got %v", s.AddrPort, s.Labels)
+		}
+		if !s.RegisteredAt.Equal(before[i].RegisteredAt) {
+			t.Errorf("UpdateServiceLabels changed RegisteredAt of %v", s.AddrPort)
+		}
+	}
+	if before[0].Labels["env"] != "dev" {
+		t.Errorf("UpdateServiceLabels modified a copy from LocalServices")
+	}
+	if err := r.UpdateServiceLabels("missing", nil); err == nil {
+		t.Errorf("Expected error updating missing service")
+	}
+
+	if err := r.UnlistServiceByName("web"); err != nil {
+		t.Fatalf("UnlistServiceByName failed: %v", err)
+	}
+	if ss := r.LocalServices(); len(ss) != 1 || ss[0].Name != "db" {
+		t.Errorf("Expected only db to remain, got %v", ss)
+	}
+	if err := r.UnlistServiceByName("web"); err == nil {
+		t.Errorf("Expected error unlisting missing service")
+	}
+}
+
+func TestUpdateAndUnlistAt(t *testing.T) {
+	r := newTestRegistry()
+	r.AdvertiseService(1001, "web", map[string]string{"env": "dev"})
+	r.AdvertiseService(1002, "web", map[string]string{"env": "dev"})
+	first := netip.MustParseAddrPort("127.0.0.2:1001")
+	second := netip.MustParseAddrPort("127.0.0.2:1002")
+
+	if err := r.UpdateServiceLabelsAt(first, map[string]string{"env": "prod"}); err != nil {
+		t.Fatalf("UpdateServiceLabelsAt failed: %v", err)
+	}
+	ss := r.LocalServices()
+	if ss[0].Labels["env"] != "prod" || ss[1].Labels["env"] != "dev" {
+		t.Errorf("Expected only the first service to be updated, got %v", ss)
+	}
+	if err := r.UnlistServiceAt(second); err != nil {
+		t.Fatalf("UnlistServiceAt failed: %v", err)
+	}
+	if ss := r.LocalServices(); len(ss) != 1 || ss[0].AddrPort != first {
+		t.Errorf("Expected only %s to remain, got %v", first, ss)
+	}
+	if err := r.UnlistServiceAt(second); err == nil {
+		t.Errorf("Expected error unlisting missing service")
+	}
+}
+
+func TestCustomPort(t *testing.T) {
+	oldAddr := fakeTailnetMap.LocalAddr
+	fakeTailnetMap.LocalAddr = netip.MustParseAddr("127.0.0.19")
+	defer func() { fakeTailnetMap.LocalAddr = oldAddr }()
+	opts := StartRegistryOptions{Port: 28014}
+	leader, err := StartRegistryWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	if want := netip.MustParseAddrPort("127.0.0.19:28014"); leader.Addr() != want {
+		t.Errorf("Expected leader at %v, got %v", want, leader.Addr())
+	}
+	delegate, err := StartRegistryWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delegate.Close()
+	if delegate.Role() != RoleDelegate {
+		t.Errorf("Expected second registry to be a delegate, got %v", delegate.Role())
+	}
+	delegate.AdvertiseService(1234, "tenant", nil)
+
+	hosts := []netip.Addr{fakeTailnetMap.LocalAddr}
+	ss, err := ListServicesWithOptions(QueryOptions{Hosts: hosts, Port: 28014})
+	if err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	if len(ss) != 1 || ss[0].Name != "tenant" {
+		t.Errorf("Expected the tenant service, got %v", ss)
+	}
+	ss, _ = ListServicesWithOptions(QueryOptions{Hosts: hosts})
+	if len(ss) != 0 {
+		t.Errorf("Expected no services on the default port, got %v", ss)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	err := registry.AdvertiseService(1235, "payments", nil, WithAliases("billing", "invoices"))
+	if err != nil {
+		t.Fatalf("AdvertiseService failed: %v", err)
+	}
+	defer registry.UnlistService(1235)
+	expected := netip.MustParseAddrPort("127.0.0.2:1235")
+	for _, name := range []string{"payments", "billing", "invoices"} {
+		if ap, err := FindService(name, nil); err != nil || ap != expected {
+			t.Errorf("FindService(%q) = %v, %v; want %v", name, ap, err, expected)
+		}
+	}
+	ss, err := FindServicesPattern("bill*", nil, Glob)
+	if err != nil || len(ss) != 1 {
+		t.Fatalf("Expected one service matching bill*, got %v, %v", ss, err)
+	}
+	// Aliases survive the round trip through /services.
+	if want := []string{"billing", "invoices"}; !slices.Equal(ss[0].Aliases, want) {
+		t.Errorf("Expected aliases %v, got %v", want, ss[0].Aliases)
+	}
+}
@@ -0,0 +1,63 @@
+// Per-client rate limiting for the registry's HTTP handlers.
+package minidisc
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// maxIdleBuckets is how many clients the rate limiter tracks before it drops
+// those that have been idle long enough to be back at full burst.
+const maxIdleBuckets = 1024
+
+// rateLimiter is a token bucket per client address. Each bucket holds up to one
+// second's worth of requests and refills continuously.
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	buckets map[netip.Addr]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(requestsPerSecond int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(requestsPerSecond),
+		buckets: make(map[netip.Addr]*bucket),
+	}
+}
+
+// allow takes a token from addr's bucket, if there is one.
+func (l *rateLimiter) allow(addr netip.Addr, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, ok := l.buckets[addr]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: l.rate, last: now}
+		l.buckets[addr] = b
+	}
+	b.tokens = min(l.rate, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops buckets that have refilled completely, since they're no different
+// from new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	for addr, b := range l.buckets {
+		if now.Sub(b.last) >= time.Second {
+			delete(l.buckets, addr)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package minidisc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2)
+	a := netip.MustParseAddr("100.64.0.1")
+	b := netip.MustParseAddr("100.64.0.2")
+	now := time.Now()
+	if !l.allow(a, now) || !l.allow(a, now) {
+		t.Fatal("Expected burst of 2 requests to be allowed")
+	}
+	if l.allow(a, now) {
+		t.Error("Expected third request to be rejected")
+	}
+	if !l.allow(b, now) {
+		t.Error("Expected other client to be allowed")
+	}
+	if !l.allow(a, now.Add(500*time.Millisecond)) {
+		t.Error("Expected request to be allowed after refill")
+	}
+	if l.allow(a, now.Add(500*time.Millisecond)) {
+		t.Error("Expected bucket to be empty again")
+	}
+
+	// Idle buckets get dropped once there are too many.
+	for i := range maxIdleBuckets {
+		l.allow(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), now)
+	}
+	l.allow(netip.MustParseAddr("100.64.0.3"), now.Add(time.Minute))
+	if len(l.buckets) != 1 {
+		t.Errorf("Expected idle buckets to be dropped, have %d", len(l.buckets))
+	}
+}
+
+func TestRegistryRateLimit(t *testing.T) {
+	r := newTestRegistry()
+	r.limiter = newRateLimiter(1)
+	get := func(path, remote string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	cases := []struct {
+		title  string
+		path   string
+		remote string
+		want   int
+	}{
+		{"first request", "/services", "100.64.0.1:1234", http.StatusOK},
+		{"second request", "/services", "100.64.0.1:1235", http.StatusTooManyRequests},
+		{"other client", "/services", "100.64.0.2:1234", http.StatusOK},
+		{"ping", "/ping", "100.64.0.1:1234", http.StatusOK},
+		{"local host", "/services", "127.0.0.2:1234", http.StatusOK},
+		{"local host again", "/services", "127.0.0.2:1234", http.StatusOK},
+	}
+	for _, c := range cases {
+		if got := get(c.path, c.remote); got != c.want {
+			t.Errorf("%s: expected status %d, got %d", c.title, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Host-specific values in labels, filled in when a service is advertised.
+package minidisc
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// Label values of local services can refer to the following variables as
+// "{{name}}", which the registry replaces when the service is advertised. This
+// allows one config to label services correctly on every host. "{{{{" stands
+// for a literal "{{". Labels of remote services are taken as they are, as the
+// variables describe the wrong host.
+const (
+	// LabelVarHostname is the host name as reported by the OS.
+	LabelVarHostname = "hostname"
+	// LabelVarTailnetIP is the registry's Tailnet IPv4 address.
+	LabelVarTailnetIP = "tailnet_ip"
+	// LabelVarOS is the operating system, as in runtime.GOOS.
+	LabelVarOS = "os"
+	// LabelVarArch is the CPU architecture, as in runtime.GOARCH.
+	LabelVarArch = "arch"
+)
+
+// labelVarRe matches an escaped "{{" or a variable reference in a label value,
+// allowing spaces around the name as in "{{ hostname }}".
+var labelVarRe = regexp.MustCompile(`\{\{\{\{|\{\{\s*([^{}]*?)\s*\}\}`)
+
+// labelVarEscape is how label values write a literal "{{".
+const labelVarEscape = "{{{{"
+
+// expandLabels returns labels with variable references in their values
+// replaced. Unknown variables are an error, so typos don't go unnoticed. If
+// there are no references, it returns labels itself.
+func (r *Registry) expandLabels(labels map[string]string) (map[string]string, error) {
+	var vars map[string]string
+	var result map[string]string
+	for k, v := range labels {
+		if !strings.Contains(v, "{{") {
+			continue
+		}
+		if vars == nil {
+			var err error
+			if vars, err = r.labelVars(); err != nil {
+				return nil, err
+			}
+			result = make(map[string]string, len(labels))
+		}
+		var unknown []string
+		result[k] = labelVarRe.ReplaceAllStringFunc(v, func(ref string) string {
+			if ref == labelVarEscape {
+				return "{{"
+			}
+			name := labelVarRe.FindStringSubmatch(ref)[1]
+			value, ok := vars[name]
+			if !ok {
+				unknown = append(unknown, name)
+			}
+			return value
+		})
+		if len(unknown) > 0 {
+			return nil, fmt.Errorf("Unknown variable %q in label %s", unknown[0], k)
+		}
+	}
+	if result == nil {
+		return labels, nil
+	}
+	for k, v := range labels {
+		if _, ok := result[k]; !ok {
+			result[k] = v
+		}
+	}
+	return result, nil
+}
+
+// labelVars returns the values of the variables that labels can refer to.
+func (r *Registry) labelVars() (map[string]string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get host name: %v", err)
+	}
+	return map[string]string{
+		LabelVarHostname:  hostname,
+		LabelVarTailnetIP: r.localAddr.String(),
+		LabelVarOS:        runtime.GOOS,
+		LabelVarArch:      runtime.GOARCH,
+	}, nil
+}
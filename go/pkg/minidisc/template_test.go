@@ -0,0 +1,107 @@
+package minidisc
+
+import (
+	"net/netip"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestExpandLabels(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRegistry()
+	cases := []struct {
+		title   string
+		labels  map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"no templates", map[string]string{"env": "prod"}, map[string]string{"env": "prod"}, false},
+		{"hostname", map[string]string{"host": "{{hostname}}"}, map[string]string{"host": hostname}, false},
+		{
+			"several variables",
+			map[string]string{"ip": "{{ tailnet_ip }}", "platform": "{{os}}/{{arch}}", "env": "prod"},
+			map[string]string{
+				"ip": "127.0.0.2", "platform": runtime.GOOS + "/" + runtime.GOARCH, "env": "prod",
+			},
+			false,
+		},
+		{"unclosed", map[string]string{"x": "{{hostname"}, map[string]string{"x": "{{hostname"}, false},
+		{"unknown variable", map[string]string{"x": "{{hostnmae}}"}, nil, true},
+		{"escaped", map[string]string{"x": "{{{{hostname}}"}, map[string]string{"x": "{{hostname}}"}, false},
+		{"escape and variable", map[string]string{"x": "{{{{ {{os}}"}, map[string]string{"x": "{{ " + runtime.GOOS}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.title, func(t *testing.T) {
+			got, err := r.expandLabels(c.labels)
+			if c.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandLabels failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Expected %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestAdvertiseLabelTemplates(t *testing.T) {
+	r := newTestRegistry()
+	labels := map[string]string{"ip": "{{tailnet_ip}}"}
+	if err := r.AdvertiseService(4000, "templated", labels); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.LocalServices()[0].Labels["ip"]; got != "127.0.0.2" {
+		t.Errorf("Expected ip label 127.0.0.2, got %s", got)
+	}
+	if labels["ip"] != "{{tailnet_ip}}" {
+		t.Errorf("Expected caller's labels to stay unchanged, got %v", labels)
+	}
+	if err := r.UpdateServiceLabels("templated", map[string]string{"os": "{{os}}"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.LocalServices()[0].Labels["os"]; got != runtime.GOOS {
+		t.Errorf("Expected os label %s, got %s", runtime.GOOS, got)
+	}
+	if err := r.AdvertiseService(4001, "typo", map[string]string{"x": "{{nope}}"}); err == nil {
+		t.Errorf("Expected error for unknown variable")
+	}
+}
+
+func TestRemoteLabelsNotExpanded(t *testing.T) {
+	r := newTestRegistry()
+	ap := netip.MustParseAddrPort("100.64.0.9:80")
+	labels := map[string]string{"ip": "{{tailnet_ip}}", "raw": "{{custom}}"}
+	if err := r.AdvertiseRemoteService(ap, "remote", labels); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AdvertiseService(4000, "remote", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.LocalServices()[0].Labels; !reflect.DeepEqual(got, labels) {
+		t.Errorf("Expected labels %v, got %v", labels, got)
+	}
+	// Updating by name expands the labels of the local service only.
+	if err := r.UpdateServiceLabels("remote", map[string]string{"ip": "{{tailnet_ip}}"}); err != nil {
+		t.Fatal(err)
+	}
+	ss := r.LocalServices()
+	if got := ss[0].Labels["ip"]; got != "{{tailnet_ip}}" {
+		t.Errorf("Expected remote label unexpanded, got %s", got)
+	}
+	if got := ss[1].Labels["ip"]; got != "127.0.0.2" {
+		t.Errorf("Expected local label 127.0.0.2, got %s", got)
+	}
+	if err := r.UpdateServiceLabelsAt(ap, map[string]string{"x": "{{nope}}"}); err != nil {
+		t.Errorf("Expected remote labels to be taken as they are: %v", err)
+	}
+}
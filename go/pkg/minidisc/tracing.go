@@ -0,0 +1,78 @@
+// Pluggable tracing of discovery operations.
+//
+// Minidisc doesn't depend on a tracing library. To trace with OpenTelemetry,
+// implement Tracer with a few lines around otel.Tracer(...).Start and the
+// propagator's Inject and Extract (using propagation.HeaderCarrier), and pass
+// it to SetTracer.
+package minidisc
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Tracer creates spans around discovery operations, and propagates the trace
+// context to the registries that are queried.
+type Tracer interface {
+	// Start begins a span named name, as child of the span in ctx, if any.
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Inject adds the trace context of ctx to the headers of a request.
+	Inject(ctx context.Context, header http.Header)
+	// Extract returns ctx with the trace context from the headers of a request.
+	Extract(ctx context.Context, header http.Header) context.Context
+}
+
+// Span is an operation started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value any)
+	RecordError(err error)
+	End()
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+func (noopTracer) Inject(ctx context.Context, header http.Header) {}
+func (noopTracer) Extract(ctx context.Context, header http.Header) context.Context {
+	return ctx
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value any) {}
+func (noopSpan) RecordError(err error)              {}
+func (noopSpan) End()                               {}
+
+var (
+	tracerMutex sync.Mutex
+	tracer      Tracer = noopTracer{}
+)
+
+// SetTracer enables tracing with t. Nil disables it again.
+func SetTracer(t Tracer) {
+	tracerMutex.Lock()
+	defer tracerMutex.Unlock()
+	if t == nil {
+		t = noopTracer{}
+	}
+	tracer = t
+}
+
+// GetTracer returns the tracer set with SetTracer, so that packages building on
+// this one can trace through it, too.
+func GetTracer() Tracer {
+	tracerMutex.Lock()
+	defer tracerMutex.Unlock()
+	return tracer
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,117 @@
+package minidisc
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// recordingTracer records spans and propagates the name of the current one.
+type recordingTracer struct {
+	mutex sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	tracer *recordingTracer
+	name   string
+	parent string
+	attrs  map[string]any
+	ended  bool
+}
+
+type spanKey struct{}
+
+const spanHeader = "X-Test-Span"
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(string)
+	span := &recordedSpan{tracer: t, name: name, parent: parent, attrs: map[string]any{}}
+	t.mutex.Lock()
+	t.spans = append(t.spans, span)
+	t.mutex.Unlock()
+	return context.WithValue(ctx, spanKey{}, name), span
+}
+
+func (t *recordingTracer) Inject(ctx context.Context, header http.Header) {
+	if name, ok := ctx.Value(spanKey{}).(string); ok {
+		header.Set(spanHeader, name)
+	}
+}
+
+func (t *recordingTracer) Extract(ctx context.Context, header http.Header) context.Context {
+	if name := header.Get(spanHeader); name != "" {
+		return context.WithValue(ctx, spanKey{}, name)
+	}
+	return ctx
+}
+
+func (s *recordedSpan) SetAttribute(key string, value any) {
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) RecordError(err error) {
+	s.SetAttribute("error", err)
+}
+
+func (s *recordedSpan) End() {
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.ended = true
+}
+
+// find returns the spans named name with the given parent.
+func (t *recordingTracer) find(name, parent string) []recordedSpan {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var result []recordedSpan
+	for _, s := range t.spans {
+		if s.name == name && s.parent == parent {
+			result = append(result, *s)
+		}
+	}
+	return result
+}
+
+func TestTracing(t *testing.T) {
+	tracer := &recordingTracer{}
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	ss, err := ListServices()
+	if err != nil {
+		t.Fatalf("ListServices failed: %v", err)
+	}
+	roots := tracer.find("minidisc.ListServices", "")
+	if len(roots) != 1 || !roots[0].ended {
+		t.Fatalf("Expected one ended ListServices span, got %v", roots)
+	}
+	if got := roots[0].attrs["minidisc.service_count"]; got != len(ss) {
+		t.Errorf("Expected service count %d, got %v", len(ss), got)
+	}
+
+	queries := tracer.find("minidisc.getRemoteServices", "minidisc.ListServices")
+	peers := make(map[any]bool)
+	for _, q := range queries {
+		if !q.ended {
+			t.Errorf("Span for query to %v wasn't ended", q.attrs["minidisc.peer"])
+		}
+		peers[q.attrs["minidisc.peer"]] = true
+	}
+	for _, peer := range []string{"127.0.0.2:28004", "127.0.0.3:28004", "127.0.0.4:28004"} {
+		if !peers[peer] {
+			t.Errorf("No span for query to %s, have %v", peer, peers)
+		}
+	}
+
+	// The trace continues on the leader, and from there to its delegate.
+	if len(tracer.find("minidisc.handleGetServices", "minidisc.getRemoteServices")) == 0 {
+		t.Error("Trace context wasn't propagated to the registry")
+	}
+	if len(tracer.find("minidisc.getRemoteServices", "minidisc.handleGetServices")) == 0 {
+		t.Error("Registry didn't trace the query to its delegate")
+	}
+}